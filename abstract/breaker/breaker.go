@@ -0,0 +1,147 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type State uint8
+
+const (
+	//Closed lets all calls through
+	Closed State = iota
+	//Open rejects calls until cooldown passes
+	Open
+	//HalfOpen lets one probe call through. Its result closes
+	//or opens the breaker again
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+var ErrOpen = errors.New("Circuit breaker is open")
+
+//Breaker counts consecutive failures. When count reaches threshold,
+//breaker opens for cooldown. It is safe for concurrent use
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	current   State
+	openedAt  time.Time
+	probing   bool
+	mu        sync.Mutex
+}
+
+func New(threshold int, cooldown time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+//State returns current state. Open breaker becomes half-open
+//after cooldown
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state()
+}
+
+func (b *Breaker) state() State {
+	if b.current == Open && time.Now().Sub(b.openedAt) >= b.cooldown {
+		b.current = HalfOpen
+		b.probing = false
+	}
+
+	return b.current
+}
+
+//Allow reports whether call may be done. In half-open state only
+//one caller is allowed until its result is reported
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state() {
+	case Closed:
+		return true
+	case HalfOpen:
+		if b.probing {
+			return false
+		}
+
+		b.probing = true
+
+		return true
+	default:
+		return false
+	}
+}
+
+//Success closes breaker
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	b.current = Closed
+}
+
+//Failure opens breaker if threshold is reached or probe failed
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+
+	if b.state() == HalfOpen || b.failures >= b.threshold {
+		b.current = Open
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
+
+//Cancel reports that allowed call was not made, so half-open
+//breaker lets next probe through
+func (b *Breaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+//Do calls f if breaker allows it and reports its result
+func (b *Breaker) Do(f func() error) error {
+	if !b.Allow() {
+		return ErrOpen
+	}
+
+	if err := f(); err != nil {
+		b.Failure()
+
+		return err
+	}
+
+	b.Success()
+
+	return nil
+}
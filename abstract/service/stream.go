@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+)
+
+const DefaultPollInterval = time.Second
+
+//RunOptions describes continuous processing of events
+type RunOptions struct {
+	//MaxBatchSize limits count of events processed at once.
+	//Zero means no limit
+	MaxBatchSize int
+
+	//Linger is time to wait for more events after the first signal
+	Linger time.Duration
+
+	//PollInterval is used for repositories, which are not able to
+	//notify about new events, and after processing errors
+	PollInterval time.Duration
+
+	//Adapters by event name. WithoutAdapting is used by default
+	Adapters map[string]app.EventAdapter
+
+	NeedLogNotProcessedEvents bool
+}
+
+//Run processes events of every registered event name until ctx is done.
+//In-flight batches are finished before Run returns
+func (srv *SyncService) Run(ctx context.Context, opts RunOptions) error {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+
+	var loops []func()
+
+	for eventName := range srv.repoDef {
+		if _, isConsumerExists := srv.consDef[eventName]; !isConsumerExists {
+			continue
+		}
+
+		adapter, ok := opts.Adapters[eventName]
+		if !ok {
+			adapter = app.WithoutAdapting
+		}
+
+		evp, err := srv.processor(eventName, adapter)
+		if err != nil {
+			return err
+		}
+
+		evp.WithBatchSize(opts.MaxBatchSize)
+
+		var signal <-chan struct{}
+
+		if repo, ok := srv.repoDef[eventName].(app.NotifyingEventRepository); ok {
+			if signal, err = repo.NewEvents(eventName); err != nil {
+				return err
+			}
+		}
+
+		loops = append(loops, srv.loop(ctx, evp, signal, opts))
+	}
+
+	loopWg := sync.WaitGroup{}
+	loopWg.Add(len(loops))
+
+	for i := range loops {
+		go func(loop func()) {
+			defer loopWg.Done()
+
+			loop()
+		}(loops[i])
+	}
+
+	loopWg.Wait()
+
+	return nil
+}
+
+func (srv *SyncService) loop(ctx context.Context, evp *app.EventProcessor, signal <-chan struct{}, opts RunOptions) func() {
+	return func() {
+		for ctx.Err() == nil {
+			//Full batch is followed by the next one at once only if it confirmed
+			//something. Otherwise failed events would be received again at once
+			for {
+				stats, err := evp.ProcessBatchStats(opts.NeedLogNotProcessedEvents)
+
+				if err != nil || opts.MaxBatchSize <= 0 || stats.Received < opts.MaxBatchSize || stats.Confirmed == 0 || ctx.Err() != nil {
+					break
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-signal:
+			case <-time.After(opts.PollInterval):
+			}
+
+			if opts.Linger > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(opts.Linger):
+				}
+			}
+		}
+	}
+}
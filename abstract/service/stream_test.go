@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DmitriBeattie/custom-framework/impl/app/event_processing/repositories"
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+	"github.com/DmitriBeattie/custom-framework/provider"
+)
+
+const (
+	eventName = "order"
+	subject   = "orders"
+)
+
+//countingConsumer fails events with payload "fail"
+type countingConsumer struct {
+	calls int32
+}
+
+func (c *countingConsumer) Name() string {
+	return "counter"
+}
+
+func (c *countingConsumer) Consume(conf *app.TaskConfig) error {
+	atomic.AddInt32(&c.calls, 1)
+
+	events := conf.ShowEvents()
+
+	for _, id := range conf.EventIDs() {
+		if string(events[id].([]byte)) == "fail" {
+			conf.SetError(id, errors.New("Order is rejected"))
+		}
+	}
+
+	return nil
+}
+
+type silentLogger struct{}
+
+func (silentLogger) Info(msg interface{}, data ...interface{})  {}
+func (silentLogger) Error(msg interface{}, data ...interface{}) {}
+
+func run(t *testing.T, d time.Duration, opts RunOptions, payloads ...string) (*countingConsumer, *provider.Memory) {
+	b := provider.NewMemoryBroker(time.Minute, 0)
+
+	if err := b.Subscribe(subject); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range payloads {
+		if err := b.Publish(subject, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cons := &countingConsumer{}
+
+	srv := NewSyncService(
+		map[string]app.EventRepository{eventName: repositories.NatsRepository(b, map[string]string{eventName: subject})},
+		map[string]app.EventConsumer{eventName: cons},
+		silentLogger{},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	if err := srv.Run(ctx, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	return cons, b
+}
+
+func TestRunWaitsAfterFailedFullBatch(t *testing.T) {
+	cons, b := run(t, 200*time.Millisecond, RunOptions{MaxBatchSize: 1, PollInterval: time.Second}, "fail", "ok")
+
+	if calls := atomic.LoadInt32(&cons.calls); calls != 1 {
+		t.Fatalf("Expected one batch before poll interval, got %d", calls)
+	}
+
+	if pending := b.Pending(subject); pending != 2 {
+		t.Fatalf("Expected failed and blocked events to stay pending, got %d", pending)
+	}
+}
+
+func TestRunContinuesAfterConfirmedFullBatch(t *testing.T) {
+	cons, b := run(t, 200*time.Millisecond, RunOptions{MaxBatchSize: 2, PollInterval: time.Second}, "ok", "ok", "ok", "ok", "ok")
+
+	if calls := atomic.LoadInt32(&cons.calls); calls != 3 {
+		t.Fatalf("Expected 3 batches before poll interval, got %d", calls)
+	}
+
+	if pending := b.Pending(subject); pending != 0 {
+		t.Fatalf("Expected all events to be acknowledged, got %d pending", pending)
+	}
+}
@@ -6,9 +6,12 @@ import (
 )
 
 type SyncService struct {
-	repoDef map[string]app.EventRepository
-	consDef map[string]app.EventConsumer
-	log app.Logger
+	repoDef      map[string]app.EventRepository
+	consDef      map[string]app.EventConsumer
+	deadLetters  map[string]*app.DeadLetterPolicy
+	interceptors *app.InterceptorChain
+	store        app.IdempotencyStore
+	log          app.Logger
 }
 
 func NewSyncService(
@@ -17,22 +20,65 @@ func NewSyncService(
 	_log app.Logger,
 ) *SyncService {
 	return &SyncService{
-		repoDef: _repoDef,
-		consDef: _consDef,
-		log:     _log,
+		repoDef:     _repoDef,
+		consDef:     _consDef,
+		deadLetters: make(map[string]*app.DeadLetterPolicy),
+		log:         _log,
 	}
 }
 
-func (srv *SyncService) Exec(eventName string, adapter app.EventAdapter, needLogNotProcessedEvents bool) error {
+//WithInterceptors wraps stages of every event processing by chain
+func (srv *SyncService) WithInterceptors(chain *app.InterceptorChain) *SyncService {
+	srv.interceptors = chain
+
+	return srv
+}
+
+//WithIdempotency makes every event processing skip events found in store
+func (srv *SyncService) WithIdempotency(store app.IdempotencyStore) *SyncService {
+	srv.store = store
+
+	return srv
+}
+
+//WithDeadLetter sets dead letter policy for event. Policy keeps
+//attempts of events between Exec calls
+func (srv *SyncService) WithDeadLetter(eventName string, p *app.DeadLetterPolicy) *SyncService {
+	srv.deadLetters[eventName] = p
+
+	return srv
+}
+
+func (srv *SyncService) processor(eventName string, adapter app.EventAdapter) (*app.EventProcessor, error) {
 	repo, isRepoExists := srv.repoDef[eventName]
 	if !isRepoExists {
-		return fmt.Errorf("Not found event repo with name: %s", eventName)
+		return nil, fmt.Errorf("Not found event repo with name: %s", eventName)
 	}
 
 	cons, isConsumerExists := srv.consDef[eventName]
 	if !isConsumerExists {
-		return fmt.Errorf("Not found consumer with name: %s", eventName)
+		return nil, fmt.Errorf("Not found consumer with name: %s", eventName)
+	}
+
+	evp := app.NewEventProcessor(repo, cons, eventName, adapter, srv.log).
+		WithInterceptors(srv.interceptors)
+
+	if srv.store != nil {
+		evp.WithIdempotency(srv.store)
+	}
+
+	if p, ok := srv.deadLetters[eventName]; ok {
+		evp.WithDeadLetter(p)
+	}
+
+	return evp, nil
+}
+
+func (srv *SyncService) Exec(eventName string, adapter app.EventAdapter, needLogNotProcessedEvents bool) error {
+	evp, err := srv.processor(eventName, adapter)
+	if err != nil {
+		return err
 	}
 
-	return app.NewEventProcessor(repo, cons, eventName, adapter, srv.log).Process(needLogNotProcessedEvents)
+	return evp.Process(needLogNotProcessedEvents)
 }
@@ -6,11 +6,18 @@ import (
 	"github.com/nats-io/stan.go"
 )
 
+const (
+	BackendStreaming = "streaming"
+	BackendJetStream = "jetstream"
+)
+
 type Nats struct {
 	Clusters    []Cluster            `json:"clusters"`
 	ClusterName string               `json:"name"`
 	Client      string               `json:"client"`
 	Queue       map[string]QueueData `json:"queue"`
+	//Backend is BackendStreaming by default
+	Backend string `json:"backend,omitempty"`
 }
 
 type QueueData struct {
@@ -20,6 +27,10 @@ type QueueData struct {
 	StartAtTime     *string `json:"startAtTime,omitempty"`
 	AckWaitSeconds  *int    `json:"ackWaitSeconds"`
 	IsManualAck     bool    `json:"isManualAck"`
+	//BufferSize limits count of not acknowledged messages kept in memory
+	BufferSize *int `json:"bufferSize,omitempty"`
+	//QueueGroup makes replicas with the same group share messages of queue
+	QueueGroup string `json:"queueGroup,omitempty"`
 }
 
 func (n *Nats) InstanceKind() string {
@@ -43,6 +54,10 @@ func (n *Nats) Url() string {
 	return u
 }
 
+func (n *Nats) IsJetStream() bool {
+	return n.Backend == BackendJetStream
+}
+
 func (n *Nats) SubscriptionOptions() map[string][]stan.SubscriptionOption {
 	result := make(map[string][]stan.SubscriptionOption, len(n.Queue))
 
@@ -78,3 +93,29 @@ func (n *Nats) SubscriptionOptions() map[string][]stan.SubscriptionOption {
 
 	return result
 }
+
+//BufferSizes returns buffer sizes of queues, which have it
+func (n *Nats) BufferSizes() map[string]int {
+	result := make(map[string]int, len(n.Queue))
+
+	for subject, settings := range n.Queue {
+		if settings.BufferSize != nil {
+			result[subject] = *settings.BufferSize
+		}
+	}
+
+	return result
+}
+
+//QueueGroups returns groups of queues read by queue subscriptions
+func (n *Nats) QueueGroups() map[string]string {
+	result := make(map[string]string, len(n.Queue))
+
+	for subject, settings := range n.Queue {
+		if settings.QueueGroup != "" {
+			result[subject] = settings.QueueGroup
+		}
+	}
+
+	return result
+}
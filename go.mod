@@ -17,12 +17,14 @@ require (
 	github.com/lib/pq v1.10.0 // indirect
 	github.com/matryer/resync v0.0.0-20161211202428-d39c09a11215 // indirect
 	github.com/nats-io/nats-streaming-server v0.21.1 // indirect
+	github.com/nats-io/nats.go v1.11.0
 	github.com/nats-io/stan.go v0.8.3 // indirect
 	github.com/sarulabs/di v2.0.0+incompatible // indirect
 	github.com/satori/go.uuid v1.2.0 // indirect
 	github.com/shiena/ansicolor v0.0.0-20200904210342-c7312218db18 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
 	github.com/technoweenie/multipartstreamer v1.0.1 // indirect
-	google.golang.org/protobuf v1.25.0 // indirect
+	github.com/vmihailenco/msgpack/v4 v4.3.12
+	google.golang.org/protobuf v1.25.0
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,116 @@
+package codecs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v4"
+	"google.golang.org/protobuf/proto"
+)
+
+//Codec converts events to bytes and back
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+//BatchCodec is implemented by codecs having own representation
+//of several events in one message
+type BatchCodec interface {
+	MarshalBatch(vs []interface{}) ([]byte, error)
+}
+
+//MarshalBatch encodes events to one message. If codec is not BatchCodec,
+//events are written one by one, each prefixed by its length as uvarint
+func MarshalBatch(c Codec, vs []interface{}) ([]byte, error) {
+	if bc, ok := c.(BatchCodec); ok {
+		return bc.MarshalBatch(vs)
+	}
+
+	var res []byte
+
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+
+	for i := range vs {
+		b, err := c.Marshal(vs[i])
+		if err != nil {
+			return nil, err
+		}
+
+		n := binary.PutUvarint(lenBuf, uint64(len(b)))
+
+		res = append(res, lenBuf[:n]...)
+		res = append(res, b...)
+	}
+
+	return res, nil
+}
+
+type jsonCodec struct{}
+
+var JSON Codec = jsonCodec{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) MarshalBatch(vs []interface{}) ([]byte, error) {
+	return json.Marshal(vs)
+}
+
+type protobufCodec struct{}
+
+//Protobuf works only with proto.Message
+var Protobuf Codec = protobufCodec{}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", v)
+	}
+
+	return proto.Marshal(msg)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", v)
+	}
+
+	return proto.Unmarshal(data, msg)
+}
+
+type msgpackCodec struct{}
+
+var Msgpack Codec = msgpackCodec{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+func (msgpackCodec) MarshalBatch(vs []interface{}) ([]byte, error) {
+	return msgpack.Marshal(vs)
+}
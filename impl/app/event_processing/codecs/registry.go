@@ -0,0 +1,98 @@
+package codecs
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+type registered struct {
+	t     reflect.Type
+	codec Codec
+}
+
+//Registry keeps Go type and codec of every event
+type Registry struct {
+	events map[string]registered
+	mu     sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		events: make(map[string]registered),
+	}
+}
+
+//Register binds event with type of sample. Decoded events have the
+//same type as sample, so pass pointer to get pointers
+func (r *Registry) Register(eventName string, sample interface{}, codec Codec) *Registry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events[eventName] = registered{
+		t:     reflect.TypeOf(sample),
+		codec: codec,
+	}
+
+	return r
+}
+
+func (r *Registry) lookup(eventName string) (registered, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	reg, ok := r.events[eventName]
+
+	return reg, ok
+}
+
+//TypeName returns name of type registered for event
+func (r *Registry) TypeName(eventName string) string {
+	reg, ok := r.lookup(eventName)
+	if !ok {
+		return ""
+	}
+
+	return reg.t.String()
+}
+
+//Codec returns codec of event
+func (r *Registry) Codec(eventName string) (Codec, bool) {
+	reg, ok := r.lookup(eventName)
+
+	return reg.codec, ok
+}
+
+func (r *Registry) Decode(eventName string, data []byte) (interface{}, error) {
+	reg, ok := r.lookup(eventName)
+	if !ok {
+		return nil, fmt.Errorf("Event %s is not registered", eventName)
+	}
+
+	if reg.t.Kind() == reflect.Ptr {
+		v := reflect.New(reg.t.Elem())
+
+		if err := reg.codec.Unmarshal(data, v.Interface()); err != nil {
+			return nil, err
+		}
+
+		return v.Interface(), nil
+	}
+
+	v := reflect.New(reg.t)
+
+	if err := reg.codec.Unmarshal(data, v.Interface()); err != nil {
+		return nil, err
+	}
+
+	return v.Elem().Interface(), nil
+}
+
+func (r *Registry) Encode(eventName string, v interface{}) ([]byte, error) {
+	reg, ok := r.lookup(eventName)
+	if !ok {
+		return nil, fmt.Errorf("Event %s is not registered", eventName)
+	}
+
+	return reg.codec.Marshal(v)
+}
@@ -0,0 +1,66 @@
+package codecs
+
+import (
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+)
+
+type decodingRepository struct {
+	app.EventRepository
+	reg *Registry
+}
+
+//notifyingDecodingRepository keeps notifications of wrapped repository
+type notifyingDecodingRepository struct {
+	*decodingRepository
+	notifying app.NotifyingEventRepository
+}
+
+func (n *notifyingDecodingRepository) NewEvents(eventName string) (<-chan struct{}, error) {
+	return n.notifying.NewEvents(eventName)
+}
+
+//DecodingRepository decodes raw events of repo into types registered
+//in reg. Events, which are failed to decode, are excluded from the batch
+//with BadInput error. Events of not registered names are left as is.
+//If repo notifies about new events, returned repository does it too
+func DecodingRepository(repo app.EventRepository, reg *Registry) app.EventRepository {
+	d := &decodingRepository{
+		EventRepository: repo,
+		reg:             reg,
+	}
+
+	if notifying, ok := repo.(app.NotifyingEventRepository); ok {
+		return &notifyingDecodingRepository{d, notifying}
+	}
+
+	return d
+}
+
+func (d *decodingRepository) GetNew(conf *app.TaskConfig, consumerName string) error {
+	if err := d.EventRepository.GetNew(conf, consumerName); err != nil {
+		return err
+	}
+
+	if _, ok := d.reg.lookup(conf.Name); !ok {
+		return nil
+	}
+
+	for id, event := range conf.ShowEvents() {
+		data, ok := event.([]byte)
+		if !ok {
+			continue
+		}
+
+		decoded, err := d.reg.Decode(conf.Name, data)
+		if err != nil {
+			conf.BadInput(id, d.reg.TypeName(conf.Name))
+			conf.ExcludeEvent(id)
+
+			continue
+		}
+
+		conf.WriteEvent(id, decoded)
+	}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+package consumers
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DmitriBeattie/custom-framework/impl/app/event_processing/codecs"
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+	"github.com/DmitriBeattie/custom-framework/provider"
+)
+
+//maxErrorBodyLen limits part of response body kept in StatusError
+const maxErrorBodyLen = 512
+
+//DefaultHTTPTimeout limits request of webhook without own client
+const DefaultHTTPTimeout = 30 * time.Second
+
+//StatusError is returned when service responds with not 2xx status code
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("Service responded with status %d: %s", e.StatusCode, e.Body)
+}
+
+//Temporary reports whether the same request may succeed later.
+//401 and 403 are temporary, because token may be expired or rotated
+func (e StatusError) Temporary() bool {
+	return e.StatusCode >= http.StatusInternalServerError ||
+		e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode == http.StatusUnauthorized ||
+		e.StatusCode == http.StatusForbidden
+}
+
+//Permanent makes dead letter policy to move event at once, because
+//repeating request is useless
+func (e StatusError) Permanent() bool {
+	return !e.Temporary()
+}
+
+//URLTemplate returns values replacing {pattern} parts of request url for event
+type URLTemplate func(taskConfig *app.TaskConfig, id app.ID, event interface{}) map[string]string
+
+type webhook struct {
+	req      *provider.ServiceRequest
+	client   *http.Client
+	name     string
+	codec    codecs.Codec
+	template URLTemplate
+}
+
+//HTTP sends events to service described by req. Authorization is made
+//by request decorator of req. Consume sends the batch, ConsumeEvent
+//sends one event and may be used with app.NewPoolConsumer
+func HTTP(req *provider.ServiceRequest, name string) *webhook {
+	return &webhook{
+		req:    req,
+		client: &http.Client{Timeout: DefaultHTTPTimeout},
+		name:   name,
+		codec:  codecs.JSON,
+	}
+}
+
+//WithClient sets client of requests. Client should have timeout,
+//otherwise not responding service blocks processing
+func (w *webhook) WithClient(c *http.Client) *webhook {
+	w.client = c
+
+	return w
+}
+
+//WithCodec sets codec for request body. JSON is used by default
+func (w *webhook) WithCodec(c codecs.Codec) *webhook {
+	w.codec = c
+
+	return w
+}
+
+//WithURLTemplate sets replacements of url patterns. In batch mode
+//events with the same replacements are sent in one request
+func (w *webhook) WithURLTemplate(t URLTemplate) *webhook {
+	w.template = t
+
+	return w
+}
+
+func (w *webhook) Name() string {
+	return w.name
+}
+
+func contentType(c codecs.Codec) string {
+	switch c.Name() {
+	case "json":
+		return "application/json"
+	case "protobuf":
+		return "application/x-protobuf"
+	case "msgpack":
+		return "application/msgpack"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+func (w *webhook) send(body []byte, urlPatternReplacement map[string]string) error {
+	header := make(http.Header)
+	header.Set("Content-Type", contentType(w.codec))
+
+	req, err := w.req.CreateRequest(bytes.NewReader(body), nil, header, urlPatternReplacement, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Do(req)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return nil
+	}
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if len(respBody) > maxErrorBodyLen {
+		respBody = respBody[:maxErrorBodyLen]
+	}
+
+	return StatusError{
+		StatusCode: resp.StatusCode,
+		Body:       string(respBody),
+	}
+}
+
+func (w *webhook) replacement(taskConfig *app.TaskConfig, id app.ID, event interface{}) map[string]string {
+	if w.template == nil {
+		return nil
+	}
+
+	return w.template(taskConfig, id, event)
+}
+
+//ConsumeEvent sends one event in request body
+func (w *webhook) ConsumeEvent(taskConfig *app.TaskConfig, id app.ID, event interface{}) error {
+	body, err := w.codec.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return w.send(body, w.replacement(taskConfig, id, event))
+}
+
+type webhookGroup struct {
+	replacement map[string]string
+	ids         []app.ID
+	events      []interface{}
+}
+
+func replacementKey(r map[string]string) string {
+	pairs := make([]string, 0, len(r))
+
+	for pattern, value := range r {
+		pairs = append(pairs, pattern+"="+value)
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+//Consume sends events of the batch in one request per url. Error
+//of request is set to all events sent in it, so other requests
+//are still acknowledged
+func (w *webhook) Consume(taskConfig *app.TaskConfig) error {
+	events := taskConfig.ShowEvents()
+	groups := make(map[string]*webhookGroup)
+
+	//Groups and events inside them keep the order of the batch
+	var order []*webhookGroup
+
+	for _, id := range taskConfig.EventIDs() {
+		event := events[id]
+
+		r := w.replacement(taskConfig, id, event)
+		key := replacementKey(r)
+
+		g, ok := groups[key]
+		if !ok {
+			g = &webhookGroup{replacement: r}
+			groups[key] = g
+			order = append(order, g)
+		}
+
+		g.ids = append(g.ids, id)
+		g.events = append(g.events, event)
+	}
+
+	for _, g := range order {
+		err := w.sendGroup(g)
+		if err == nil {
+			continue
+		}
+
+		for _, id := range g.ids {
+			taskConfig.SetError(id, err)
+		}
+	}
+
+	return nil
+}
+
+func (w *webhook) sendGroup(g *webhookGroup) error {
+	body, err := codecs.MarshalBatch(w.codec, g.events)
+	if err != nil {
+		return err
+	}
+
+	return w.send(body, g.replacement)
+}
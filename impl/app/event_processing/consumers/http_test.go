@@ -0,0 +1,86 @@
+package consumers_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/DmitriBeattie/custom-framework/impl/app/event_processing/consumers"
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+	"github.com/DmitriBeattie/custom-framework/provider"
+)
+
+func TestHTTPPoolConsumer(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received = make(map[string]bool)
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.URL.Query().Get("token") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		mu.Lock()
+		received[string(body)] = true
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	//Query is not sorted to see whether request creation changes it
+	rawURL := srv.URL + "/events?token=secret&source=test"
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cons := app.NewPoolConsumer(consumers.HTTP(&provider.ServiceRequest{U: u, Method: http.MethodPost}, "webhook"), 8)
+
+	conf := app.NewTaskConfig("event")
+	for i := 0; i < 50; i++ {
+		conf.WriteEvent(i, i)
+	}
+
+	if err := cons.Consume(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, err := range conf.ShowConsumigResult() {
+		if err != nil {
+			t.Fatalf("Event %v is not sent: %v", id, err)
+		}
+	}
+
+	if len(received) != 50 {
+		t.Fatalf("Expected 50 requests, got %d", len(received))
+	}
+
+	if u.String() != rawURL {
+		t.Fatalf("Expected url of service request to stay %s, got %s", rawURL, u.String())
+	}
+}
+
+func TestStatusErrorPermanent(t *testing.T) {
+	cases := map[int]bool{
+		http.StatusBadRequest:          true,
+		http.StatusNotFound:            true,
+		http.StatusUnauthorized:        false,
+		http.StatusForbidden:           false,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: false,
+	}
+
+	for code, permanent := range cases {
+		if res := (consumers.StatusError{StatusCode: code}).Permanent(); res != permanent {
+			t.Fatalf("Expected permanent %v of status %d, got %v", permanent, code, res)
+		}
+	}
+}
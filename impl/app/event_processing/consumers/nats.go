@@ -1,45 +1,71 @@
 package consumers
 
 import (
-	"encoding/json"
 	"fmt"
+	"github.com/DmitriBeattie/custom-framework/impl/app/event_processing/codecs"
 	"github.com/DmitriBeattie/custom-framework/interfaces/app"
 	"github.com/DmitriBeattie/custom-framework/provider"
 )
 
 type queueDefinition map[string]string
 
+//Route chooses subject for event
+type Route func(taskConfig *app.TaskConfig, id app.ID, event interface{}) (string, error)
+
 type nats struct {
-	conn      *provider.NATS
+	conn      provider.Broker
 	def    	  queueDefinition
 	name      string
+	codec     codecs.Codec
+	perEvent  bool
+	route     Route
 }
 
-func Nats(_conn *provider.NATS, _def map[string]string, _name string) *nats {
+func Nats(_conn provider.Broker, _def map[string]string, _name string) *nats {
 	return &nats{
 		conn: _conn,
 		def: _def,
 		name: _name,
+		codec: codecs.JSON,
 	}
 }
 
+//WithCodec sets codec for batch encoding. JSON is used by default
+func (n *nats) WithCodec(c codecs.Codec) *nats {
+	n.codec = c
+
+	return n
+}
+
+//WithPerEvent makes consumer publish every event in separate message
+//asynchronously. Subject is chosen by route or taken from queue
+//definition if route is nil. Ack result of event is set when server
+//acknowledges its message
+func (n *nats) WithPerEvent(route Route) *nats {
+	n.perEvent = true
+	n.route = route
+
+	return n
+}
+
 func (n *nats) Name() string {
 	return n.name
 }
 
-func consume(conn *provider.NATS, def queueDefinition, taskConfig *app.TaskConfig) (error, errCode) {
+func consume(conn provider.Broker, def queueDefinition, codec codecs.Codec, taskConfig *app.TaskConfig) (error, errCode) {
 	queue, ok := def[taskConfig.Name]
 	if !ok {
 		return nil, ErrCodeNotFoundQueue
 	}
 
 	msgs := make([]interface{}, 0, taskConfig.Len())
+	events := taskConfig.ShowEvents()
 
-	for _, val := range taskConfig.ShowEvents() {
-		msgs = append(msgs, val)
+	for _, id := range taskConfig.EventIDs() {
+		msgs = append(msgs, events[id])
 	}
 
-	msgByte, err := json.Marshal(msgs)
+	msgByte, err := codecs.MarshalBatch(codec, msgs)
 	if err != nil {
 		return err, ErrCodeBadMessage
 	}
@@ -52,7 +78,11 @@ func consume(conn *provider.NATS, def queueDefinition, taskConfig *app.TaskConfi
 }
 
 func (n *nats) Consume(taskConfig *app.TaskConfig) error {
-	err, code := consume(n.conn, n.def, taskConfig)
+	if n.perEvent {
+		return n.consumeEach(taskConfig)
+	}
+
+	err, code := consume(n.conn, n.def, n.codec, taskConfig)
 	if code == ErrCodeFailedToPublish {
 		taskConfig.SetErrorToAll(err)
 	}
@@ -63,3 +93,69 @@ func (n *nats) Consume(taskConfig *app.TaskConfig) error {
 
 	return err
 }
+
+type eventAck struct {
+	id  app.ID
+	err error
+}
+
+func (n *nats) subject(taskConfig *app.TaskConfig, id app.ID, event interface{}) (string, error) {
+	if n.route != nil {
+		return n.route(taskConfig, id, event)
+	}
+
+	queue, ok := n.def[taskConfig.Name]
+	if !ok {
+		return "", fmt.Errorf("Not found queue for event %s in %s", taskConfig.Name, n.name)
+	}
+
+	return queue, nil
+}
+
+func (n *nats) consumeEach(taskConfig *app.TaskConfig) error {
+	events := taskConfig.ShowEvents()
+	ids := taskConfig.EventIDs()
+
+	acks := make(chan eventAck, len(ids))
+
+	var pending int
+
+	for _, id := range ids {
+		if err := n.publishEvent(taskConfig, id, events[id], acks); err != nil {
+			taskConfig.SetError(id, err)
+
+			continue
+		}
+
+		pending++
+	}
+
+	for ; pending > 0; pending-- {
+		ack := <-acks
+
+		taskConfig.SetError(ack.id, ack.err)
+	}
+
+	return nil
+}
+
+func (n *nats) publishEvent(taskConfig *app.TaskConfig, id app.ID, event interface{}, acks chan<- eventAck) error {
+	subject, err := n.subject(taskConfig, id, event)
+	if err != nil {
+		return err
+	}
+
+	msg, err := n.codec.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = n.conn.PublishAsync(subject, msg, func(_ string, ackErr error) {
+		acks <- eventAck{
+			id:  id,
+			err: ackErr,
+		}
+	})
+
+	return err
+}
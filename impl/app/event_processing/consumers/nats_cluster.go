@@ -2,65 +2,145 @@ package consumers
 
 import (
 	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DmitriBeattie/custom-framework/abstract/breaker"
+	"github.com/DmitriBeattie/custom-framework/impl/app/event_processing/codecs"
 	"github.com/DmitriBeattie/custom-framework/interfaces/app"
 	"github.com/DmitriBeattie/custom-framework/provider"
 )
 
+const (
+	DefaultBreakerThreshold = 3
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
 type natsCluster struct {
-	conn []*provider.NATS
+	conn []provider.Broker
+	breakers []*breaker.Breaker
 	currentActive int
+	mu sync.Mutex
 	def    	  map[string]string
 	name      string
 	log app.Logger
+	codec codecs.Codec
 }
 
-func NewNatsCluster(def queueDefinition, name string, log app.Logger, conn ...*provider.NATS) *natsCluster {
-	return &natsCluster{
+func NewNatsCluster(def queueDefinition, name string, log app.Logger, conn ...provider.Broker) *natsCluster {
+	nC := &natsCluster{
 		conn: conn,
 		def: def,
 		name: name,
 		log: log,
+		codec: codecs.JSON,
+	}
+
+	return nC.WithBreaker(DefaultBreakerThreshold, DefaultBreakerCooldown)
+}
+
+//WithBreaker sets circuit breaker of every connection. Connection is not
+//used during cooldown after threshold consecutive publish failures
+func (nC *natsCluster) WithBreaker(threshold int, cooldown time.Duration) *natsCluster {
+	nC.breakers = make([]*breaker.Breaker, len(nC.conn))
+
+	for i := range nC.conn {
+		nC.breakers[i] = breaker.New(threshold, cooldown)
+	}
+
+	return nC
+}
+
+//ConnectionHealth describes state of connection of the cluster
+type ConnectionHealth struct {
+	Url    string
+	State  breaker.State
+	Active bool
+}
+
+//Health returns state of every connection
+func (nC *natsCluster) Health() []ConnectionHealth {
+	active := nC.active()
+
+	health := make([]ConnectionHealth, 0, len(nC.conn))
+
+	for i := range nC.conn {
+		health = append(health, ConnectionHealth{
+			Url:    nC.conn[i].Url(),
+			State:  nC.breakers[i].State(),
+			Active: i == active,
+		})
 	}
+
+	return health
+}
+
+func (nC *natsCluster) active() int {
+	nC.mu.Lock()
+	defer nC.mu.Unlock()
+
+	return nC.currentActive
+}
+
+func (nC *natsCluster) setActive(i int) {
+	nC.mu.Lock()
+	defer nC.mu.Unlock()
+
+	nC.currentActive = i
+}
+
+//WithCodec sets codec for batch encoding. JSON is used by default
+func (nC *natsCluster) WithCodec(c codecs.Codec) *natsCluster {
+	nC.codec = c
+
+	return nC
 }
 
 func (nC *natsCluster) Name() string {
 	return nC.name
 }
 
+//Consume publishes batch to the active connection. If it fails, next
+//connections with not open breaker are tried
 func (nC *natsCluster) Consume(taskConfig *app.TaskConfig) error {
-	var err error
-	var code errCode
+	if _, ok := nC.def[taskConfig.Name]; !ok {
+		return fmt.Errorf("Not found queue for event %s in cluster %s", taskConfig.Name, nC.name)
+	}
 
-	activeConn := nC.currentActive
+	err := fmt.Errorf("No healthy connection in cluster %s: %w", nC.name, breaker.ErrOpen)
+
+	activeConn := nC.active()
 
 	for i := 0; i < len(nC.conn); i++ {
-		err, code = consume(nC.conn[activeConn], nC.def, taskConfig)
-		if code == OK {
-			nC.currentActive = activeConn
+		idx := (activeConn + i) % len(nC.conn)
+		b := nC.breakers[idx]
 
-			break
+		if !b.Allow() {
+			continue
 		}
 
-		if code == ErrCodeNotFoundQueue {
-			return fmt.Errorf("Not found queue for event %s in cluster %s", taskConfig.Name, nC.name)
-		}
+		var code errCode
 
-		if code == ErrCodeFailedToPublish {
-			nC.log.Error(fmt.Errorf("Err while publish to %s: %s", nC.conn[activeConn].Url(), err.Error()))
-		}
+		err, code = consume(nC.conn[idx], nC.def, nC.codec, taskConfig)
 
-		if activeConn + 1 == len(nC.conn) {
-			activeConn = 0
-		} else {
-			activeConn += 1
-		}
-	}
+		switch code {
+		case OK:
+			b.Success()
+			nC.setActive(idx)
 
-	if code == ErrCodeFailedToPublish {
-		taskConfig.SetErrorToAll(err)
+			return nil
+		case ErrCodeFailedToPublish:
+			b.Failure()
 
-		return nil
+			nC.log.Error(fmt.Errorf("Err while publish to %s: %s", nC.conn[idx].Url(), err.Error()))
+		default:
+			b.Cancel()
+
+			return err
+		}
 	}
 
-	return err
-}
\ No newline at end of file
+	taskConfig.SetErrorToAll(err)
+
+	return nil
+}
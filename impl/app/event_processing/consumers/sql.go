@@ -0,0 +1,317 @@
+package consumers
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+	"github.com/DmitriBeattie/custom-framework/provider"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+)
+
+const (
+	DefaultUpsertChunkSize = 500
+
+	postgreSQLMaxParams = 65535
+	//Server allows 2100 parameters, sp_executesql used by driver takes two of them
+	msSQLMaxParams = 2098
+
+	tvpParamName = "rows"
+)
+
+//UpsertTable describes table receiving events. Events should be
+//structs or pointers to structs, columns are taken from db tags
+type UpsertTable struct {
+	Table string
+
+	//KeyColumns identify existing rows
+	KeyColumns []string
+
+	//Columns limits written columns. By default all
+	//top level db fields of event are written
+	Columns []string
+
+	//ChunkSize limits count of rows in one statement. It is
+	//decreased if statement exceeds limit of parameters
+	ChunkSize int
+
+	//TVPTypeName is used only by MSSQL. When it is set, rows are passed
+	//as table valued parameter, which type has columns of event
+	//struct in the same order
+	TVPTypeName string
+}
+
+type upsertRow struct {
+	id    app.ID
+	value reflect.Value
+}
+
+type sqlUpsert struct {
+	db        *sqlx.DB
+	t         UpsertTable
+	name      string
+	maxParams int
+	isMSSQL   bool
+}
+
+//PostgreSQLUpsert writes events with INSERT ... ON CONFLICT DO UPDATE
+func PostgreSQLUpsert(db *provider.PostgreSQL, table UpsertTable, name string) *sqlUpsert {
+	return newSQLUpsert(db.DB, table, name, postgreSQLMaxParams, false)
+}
+
+//MSSQLUpsert writes events with MERGE
+func MSSQLUpsert(db *provider.MSSQL, table UpsertTable, name string) *sqlUpsert {
+	return newSQLUpsert(db.DB, table, name, msSQLMaxParams, true)
+}
+
+func newSQLUpsert(db *sqlx.DB, table UpsertTable, name string, maxParams int, isMSSQL bool) *sqlUpsert {
+	if table.ChunkSize <= 0 {
+		table.ChunkSize = DefaultUpsertChunkSize
+	}
+
+	return &sqlUpsert{
+		db:        db,
+		t:         table,
+		name:      name,
+		maxParams: maxParams,
+		isMSSQL:   isMSSQL,
+	}
+}
+
+func (s *sqlUpsert) Name() string {
+	return s.name
+}
+
+func (s *sqlUpsert) columns(t reflect.Type) ([]string, [][]int, error) {
+	columns := s.t.Columns
+
+	if len(columns) == 0 {
+		for _, fi := range s.db.Mapper.TypeMap(t).Index {
+			if fi.Embedded || fi.Name == "" || strings.Contains(fi.Path, ".") {
+				continue
+			}
+
+			columns = append(columns, fi.Path)
+		}
+	}
+
+	if len(columns) == 0 {
+		return nil, nil, fmt.Errorf("No db fields in %s", t)
+	}
+
+	traversals := s.db.Mapper.TraversalsByName(t, columns)
+
+	for i := range traversals {
+		if len(traversals[i]) == 0 {
+			return nil, nil, fmt.Errorf("Column %s is not found in %s", columns[i], t)
+		}
+	}
+
+	for _, key := range s.t.KeyColumns {
+		if !containsColumn(columns, key) {
+			return nil, nil, fmt.Errorf("Key column %s is not written to %s", key, s.t.Table)
+		}
+	}
+
+	return columns, traversals, nil
+}
+
+func containsColumn(columns []string, column string) bool {
+	for i := range columns {
+		if columns[i] == column {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *sqlUpsert) chunkSize(columns []string) int {
+	if s.isMSSQL && s.t.TVPTypeName != "" {
+		return s.t.ChunkSize
+	}
+
+	if maxRows := s.maxParams / len(columns); maxRows < s.t.ChunkSize {
+		return maxRows
+	}
+
+	return s.t.ChunkSize
+}
+
+//Consume writes events grouped by type in chunks. If chunk fails,
+//its rows are written one by one to find failed events
+func (s *sqlUpsert) Consume(taskConfig *app.TaskConfig) error {
+	if len(s.t.KeyColumns) == 0 {
+		return fmt.Errorf("Key columns of %s are not set in %s", s.t.Table, s.name)
+	}
+
+	groups := make(map[reflect.Type][]upsertRow)
+	var types []reflect.Type
+
+	events := taskConfig.ShowEvents()
+
+	for _, id := range taskConfig.EventIDs() {
+		v := reflect.Indirect(reflect.ValueOf(events[id]))
+
+		if v.Kind() != reflect.Struct {
+			taskConfig.SetError(id, fmt.Errorf("Event %v of %s is not a struct", id, taskConfig.Name))
+
+			continue
+		}
+
+		if _, ok := groups[v.Type()]; !ok {
+			types = append(types, v.Type())
+		}
+
+		groups[v.Type()] = append(groups[v.Type()], upsertRow{id: id, value: v})
+	}
+
+	for _, t := range types {
+		rows := groups[t]
+
+		columns, traversals, err := s.columns(t)
+		if err != nil {
+			for i := range rows {
+				taskConfig.SetError(rows[i].id, err)
+			}
+
+			continue
+		}
+
+		size := s.chunkSize(columns)
+
+		for start := 0; start < len(rows); start += size {
+			end := start + size
+			if end > len(rows) {
+				end = len(rows)
+			}
+
+			s.writeChunk(taskConfig, rows[start:end], columns, traversals)
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlUpsert) writeChunk(taskConfig *app.TaskConfig, rows []upsertRow, columns []string, traversals [][]int) {
+	if err := s.exec(rows, columns, traversals); err == nil || len(rows) == 1 {
+		for i := range rows {
+			taskConfig.SetError(rows[i].id, err)
+		}
+
+		return
+	}
+
+	for i := range rows {
+		taskConfig.SetError(rows[i].id, s.exec(rows[i:i+1], columns, traversals))
+	}
+}
+
+func (s *sqlUpsert) exec(rows []upsertRow, columns []string, traversals [][]int) error {
+	if s.isMSSQL && s.t.TVPTypeName != "" {
+		return s.execTVP(rows, columns)
+	}
+
+	args := make([]interface{}, 0, len(rows)*len(columns))
+
+	for i := range rows {
+		for _, traversal := range traversals {
+			args = append(args, reflectx.FieldByIndexesReadOnly(rows[i].value, traversal).Interface())
+		}
+	}
+
+	placeholder := "(?" + strings.Repeat(", ?", len(columns)-1) + ")"
+	values := placeholder + strings.Repeat(", "+placeholder, len(rows)-1)
+
+	var query string
+
+	if s.isMSSQL {
+		query = s.mergeQuery("(VALUES "+values+") AS src ("+strings.Join(columns, ", ")+")", columns)
+	} else {
+		query = s.insertQuery(values, columns)
+	}
+
+	_, err := s.db.Exec(s.db.Rebind(query), args...)
+
+	return err
+}
+
+func (s *sqlUpsert) execTVP(rows []upsertRow, columns []string) error {
+	list := reflect.MakeSlice(reflect.SliceOf(rows[0].value.Type()), 0, len(rows))
+
+	for i := range rows {
+		list = reflect.Append(list, rows[i].value)
+	}
+
+	tvp := mssql.TVP{
+		TypeName: s.t.TVPTypeName,
+		Value:    list.Interface(),
+	}
+
+	_, err := s.db.Exec(s.mergeQuery("@"+tvpParamName+" AS src", columns), sql.Named(tvpParamName, tvp))
+
+	return err
+}
+
+func (s *sqlUpsert) updatedColumns(columns []string) []string {
+	var updated []string
+
+	for _, column := range columns {
+		if !containsColumn(s.t.KeyColumns, column) {
+			updated = append(updated, column)
+		}
+	}
+
+	return updated
+}
+
+func (s *sqlUpsert) insertQuery(values string, columns []string) string {
+	query := "INSERT INTO " + s.t.Table + " (" + strings.Join(columns, ", ") + ") VALUES " + values +
+		" ON CONFLICT (" + strings.Join(s.t.KeyColumns, ", ") + ") DO "
+
+	updated := s.updatedColumns(columns)
+	if len(updated) == 0 {
+		return query + "NOTHING"
+	}
+
+	set := make([]string, 0, len(updated))
+
+	for _, column := range updated {
+		set = append(set, column+" = EXCLUDED."+column)
+	}
+
+	return query + "UPDATE SET " + strings.Join(set, ", ")
+}
+
+func (s *sqlUpsert) mergeQuery(source string, columns []string) string {
+	on := make([]string, 0, len(s.t.KeyColumns))
+
+	for _, key := range s.t.KeyColumns {
+		on = append(on, "dst."+key+" = src."+key)
+	}
+
+	query := "MERGE " + s.t.Table + " WITH (HOLDLOCK) AS dst USING " + source +
+		" ON " + strings.Join(on, " AND ")
+
+	if updated := s.updatedColumns(columns); len(updated) > 0 {
+		set := make([]string, 0, len(updated))
+
+		for _, column := range updated {
+			set = append(set, "dst."+column+" = src."+column)
+		}
+
+		query += " WHEN MATCHED THEN UPDATE SET " + strings.Join(set, ", ")
+	}
+
+	src := make([]string, 0, len(columns))
+
+	for _, column := range columns {
+		src = append(src, "src."+column)
+	}
+
+	return query + " WHEN NOT MATCHED THEN INSERT (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(src, ", ") + ");"
+}
@@ -0,0 +1,44 @@
+package deadletters
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+)
+
+type file struct {
+	path string
+	mu   sync.Mutex
+}
+
+//File appends dead letters to file as json lines
+func File(path string) *file {
+	return &file{
+		path: path,
+	}
+}
+
+func (f *file) Store(letter app.DeadLetter) error {
+	line, err := json.Marshal(newRecord(letter))
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fl, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fl.Write(append(line, '\n')); err != nil {
+		fl.Close()
+
+		return err
+	}
+
+	return fl.Close()
+}
@@ -0,0 +1,40 @@
+package deadletters
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+)
+
+type record struct {
+	EventName string      `json:"eventName"`
+	ID        string      `json:"id"`
+	Payload   interface{} `json:"payload"`
+	Error     string      `json:"error"`
+	Attempts  int         `json:"attempts"`
+	FailedAt  time.Time   `json:"failedAt"`
+}
+
+func newRecord(letter app.DeadLetter) record {
+	payload := letter.Event
+
+	if b, ok := payload.([]byte); ok && json.Valid(b) {
+		payload = json.RawMessage(b)
+	}
+
+	var errText string
+	if letter.Err != nil {
+		errText = letter.Err.Error()
+	}
+
+	return record{
+		EventName: letter.EventName,
+		ID:        fmt.Sprint(letter.ID),
+		Payload:   payload,
+		Error:     errText,
+		Attempts:  letter.Attempts,
+		FailedAt:  letter.FailedAt,
+	}
+}
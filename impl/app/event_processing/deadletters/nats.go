@@ -0,0 +1,30 @@
+package deadletters
+
+import (
+	"encoding/json"
+
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+	"github.com/DmitriBeattie/custom-framework/provider"
+)
+
+type nats struct {
+	conn    provider.Broker
+	subject string
+}
+
+//Nats publishes dead letters as json to subject
+func Nats(conn provider.Broker, subject string) *nats {
+	return &nats{
+		conn:    conn,
+		subject: subject,
+	}
+}
+
+func (n *nats) Store(letter app.DeadLetter) error {
+	msg, err := json.Marshal(newRecord(letter))
+	if err != nil {
+		return err
+	}
+
+	return n.conn.Publish(n.subject, msg)
+}
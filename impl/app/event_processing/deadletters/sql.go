@@ -0,0 +1,36 @@
+package deadletters
+
+import (
+	"encoding/json"
+
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+	"github.com/jmoiron/sqlx"
+)
+
+type sqlTable struct {
+	db    *sqlx.DB
+	query string
+}
+
+//SQL inserts dead letters to table with columns
+//event_name, event_id, payload, error, attempts, failed_at
+func SQL(db *sqlx.DB, table string) *sqlTable {
+	return &sqlTable{
+		db: db,
+		query: db.Rebind("INSERT INTO " + table +
+			" (event_name, event_id, payload, error, attempts, failed_at) VALUES (?, ?, ?, ?, ?, ?)"),
+	}
+}
+
+func (s *sqlTable) Store(letter app.DeadLetter) error {
+	rec := newRecord(letter)
+
+	payload, err := json.Marshal(rec.Payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(s.query, rec.EventName, rec.ID, string(payload), rec.Error, rec.Attempts, rec.FailedAt)
+
+	return err
+}
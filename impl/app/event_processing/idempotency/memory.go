@@ -0,0 +1,69 @@
+package idempotency
+
+import (
+	"sync"
+	"time"
+
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+)
+
+type memoryKey struct {
+	eventName    string
+	consumerName string
+	id           app.ID
+}
+
+type memory struct {
+	ttl       time.Duration
+	processed map[memoryKey]time.Time
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+//Memory remembers events in memory for ttl
+func Memory(ttl time.Duration) *memory {
+	return &memory{
+		ttl:       ttl,
+		processed: make(map[memoryKey]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+func (m *memory) Processed(eventName, consumerName string, ids []app.ID) (map[app.ID]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	res := make(map[app.ID]bool, len(ids))
+
+	for _, id := range ids {
+		expiresAt, ok := m.processed[memoryKey{eventName, consumerName, id}]
+
+		res[id] = ok && now.Before(expiresAt)
+	}
+
+	return res, nil
+}
+
+func (m *memory) Remember(eventName, consumerName string, ids []app.ID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	for _, id := range ids {
+		m.processed[memoryKey{eventName, consumerName, id}] = now.Add(m.ttl)
+	}
+
+	if now.Sub(m.lastSweep) >= m.ttl {
+		for key, expiresAt := range m.processed {
+			if !now.Before(expiresAt) {
+				delete(m.processed, key)
+			}
+		}
+
+		m.lastSweep = now
+	}
+
+	return nil
+}
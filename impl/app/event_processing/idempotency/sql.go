@@ -0,0 +1,112 @@
+package idempotency
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+	"github.com/DmitriBeattie/custom-framework/provider"
+	"github.com/jmoiron/sqlx"
+)
+
+//idsPerQuery keeps count of query parameters below MSSQL limit
+const idsPerQuery = 500
+
+type sqlStore struct {
+	db          *sqlx.DB
+	table       string
+	insertQuery string
+}
+
+//PostgreSQL remembers events in table with columns
+//event_name, consumer_name, event_id, processed_at.
+//Table should have unique key on event_name, consumer_name, event_id
+func PostgreSQL(db *provider.PostgreSQL, table string) *sqlStore {
+	return &sqlStore{
+		db:    db.DB,
+		table: table,
+		insertQuery: db.Rebind("INSERT INTO " + table + " (event_name, consumer_name, event_id, processed_at) " +
+			"VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING"),
+	}
+}
+
+//MSSQL remembers events in table with columns
+//event_name, consumer_name, event_id, processed_at
+func MSSQL(db *provider.MSSQL, table string) *sqlStore {
+	return &sqlStore{
+		db:    db.DB,
+		table: table,
+		insertQuery: db.Rebind("MERGE " + table + " WITH (HOLDLOCK) AS t " +
+			"USING (SELECT ? AS event_name, ? AS consumer_name, ? AS event_id, ? AS processed_at) AS s " +
+			"ON t.event_name = s.event_name AND t.consumer_name = s.consumer_name AND t.event_id = s.event_id " +
+			"WHEN NOT MATCHED THEN INSERT (event_name, consumer_name, event_id, processed_at) " +
+			"VALUES (s.event_name, s.consumer_name, s.event_id, s.processed_at);"),
+	}
+}
+
+func (s *sqlStore) Processed(eventName, consumerName string, ids []app.ID) (map[app.ID]bool, error) {
+	res := make(map[app.ID]bool, len(ids))
+	byKey := make(map[string]app.ID, len(ids))
+
+	keys := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		key := fmt.Sprint(id)
+
+		byKey[key] = id
+		keys = append(keys, key)
+		res[id] = false
+	}
+
+	for len(keys) > 0 {
+		chunk := keys
+		if len(chunk) > idsPerQuery {
+			chunk = keys[:idsPerQuery]
+		}
+
+		keys = keys[len(chunk):]
+
+		query, args, err := sqlx.In(
+			"SELECT event_id FROM "+s.table+" WHERE event_name = ? AND consumer_name = ? AND event_id IN (?)",
+			eventName,
+			consumerName,
+			chunk,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		var found []string
+
+		if err := s.db.Select(&found, s.db.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+
+		for _, key := range found {
+			if id, ok := byKey[key]; ok {
+				res[id] = true
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (s *sqlStore) Remember(eventName, consumerName string, ids []app.ID) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for _, id := range ids {
+		if _, err := tx.Exec(s.insertQuery, eventName, consumerName, fmt.Sprint(id), now); err != nil {
+			tx.Rollback()
+
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
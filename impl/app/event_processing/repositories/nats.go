@@ -1,95 +1,173 @@
 package repositories
 
 import (
-	"errors"
 	"fmt"
 	"github.com/DmitriBeattie/custom-framework/interfaces/app"
 	"github.com/DmitriBeattie/custom-framework/provider"
-	"github.com/nats-io/stan.go"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
-type natsRepo struct {
-	conn *provider.NATS
-	q map[string]string
+//MessageID is id of event read from nats. Source is index of connection
+//in cluster, it is zero for single connection
+type MessageID struct {
+	Source   int
+	Subject  string
+	Sequence uint64
 }
 
-func NatsRepository(n *provider.NATS, q map[string]string) *natsRepo {
-	return &natsRepo{n, q}
+func (id MessageID) String() string {
+	return fmt.Sprintf("%d;%s;%d", id.Source, id.Subject, id.Sequence)
 }
 
-func (n *natsRepo) GetNew(conf *app.TaskConfig, consumerName string) error {
-	queue, ok := n.q[conf.Name]
-	if !ok {
-		return fmt.Errorf("Not found queue in nats for event %s", conf.Name)
+//unackedError lists events, which are not acknowledged in nats
+func unackedError(queue string, reason string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%d events of %s are not acknowledged, %s: %s", len(ids), queue, reason, strings.Join(ids, ", "))
+}
+
+//successfulIDs groups ids of successfully consumed events by source.
+//Ids of other type, subject or unknown source get error and are
+//returned in error, because they are never acknowledged
+func successfulIDs(conf *app.TaskConfig, queue string, sources int) (map[int][]MessageID, error) {
+	bySource := make(map[int][]MessageID)
+
+	var unknown []string
+
+	for id, err := range conf.ShowConsumigResult() {
+		if err != nil {
+			continue
+		}
+
+		mID, ok := id.(MessageID)
+		if !ok {
+			conf.SetError(id, fmt.Errorf("Unexpected id %v of type %T", id, id))
+			unknown = append(unknown, fmt.Sprint(id))
+
+			continue
+		}
+
+		if mID.Subject != queue || mID.Source < 0 || mID.Source >= sources {
+			conf.SetError(id, fmt.Errorf("Unknown message %s", mID))
+			unknown = append(unknown, mID.String())
+
+			continue
+		}
+
+		bySource[mID.Source] = append(bySource[mID.Source], mID)
 	}
 
-	indexedMsgs, err := n.conn.GetMessages(queue)
+	return bySource, unackedError(queue, "ids are unknown", unknown)
+}
+
+//ackMessages acknowledges messages kept by conn. Event gets error if its
+//message is not found, e.g. it was redelivered after reconnection
+func ackMessages(conf *app.TaskConfig, conn provider.Broker, queue string, ids []MessageID) error {
+	msgs, err := conn.GetMessages(queue, 0)
 	if err != nil {
+		err = fmt.Errorf("Reading from %s: %w", conn.Url(), err)
+
+		for i := range ids {
+			conf.SetError(ids[i], err)
+		}
+
 		return err
 	}
 
-	conf.AllocateMemForEvents(len(indexedMsgs))
+	indexedMsgs := make(map[uint64]*provider.Message, len(msgs))
 
-	for id, msg := range indexedMsgs {
-		conf.WriteEvent(id, msg.Data)
+	for _, msg := range msgs {
+		indexedMsgs[msg.Sequence] = msg
 	}
 
-	return nil
+	acknowledgedMsgs := make(map[uint64]*provider.Message, len(ids))
+
+	var notFound []string
+
+	for i := range ids {
+		msg, ok := indexedMsgs[ids[i].Sequence]
+		if !ok {
+			conf.SetError(ids[i], fmt.Errorf("Not found msg with id %d in server %d", ids[i].Sequence, ids[i].Source))
+			notFound = append(notFound, ids[i].String())
+
+			continue
+		}
+
+		acknowledgedMsgs[ids[i].Sequence] = msg
+	}
+
+	if len(acknowledgedMsgs) > 0 {
+		conn.Ack(acknowledgedMsgs, queue)
+	}
+
+	return unackedError(queue, "messages are not found in "+conn.Url(), notFound)
 }
 
-func (n *natsRepo) ConfirmAck(conf *app.TaskConfig, consumerName string) error {
+type natsRepo struct {
+	conn provider.Broker
+	q map[string]string
+}
+
+func NatsRepository(n provider.Broker, q map[string]string) *natsRepo {
+	return &natsRepo{n, q}
+}
+
+func (n *natsRepo) GetNew(conf *app.TaskConfig, consumerName string) error {
 	queue, ok := n.q[conf.Name]
 	if !ok {
 		return fmt.Errorf("Not found queue in nats for event %s", conf.Name)
 	}
 
-	acknowledgedMsgs := make(map[uint64]*stan.Msg, conf.Len())
-
-	msgs, err := n.conn.GetMessages(queue)
+	msgs, err := n.conn.GetMessages(queue, conf.Limit())
 	if err != nil {
 		return err
 	}
 
-	for id, err := range conf.ShowConsumigResult() {
-		if err != nil {
-			continue
-		}
+	conf.AllocateMemForEvents(len(msgs))
 
-		acknowledgedMsgs[id.(uint64)] = msgs[id.(uint64)]
+	for _, msg := range msgs {
+		conf.WriteEvent(MessageID{Subject: queue, Sequence: msg.Sequence}, msg.Data)
 	}
 
-	n.conn.Ack(acknowledgedMsgs, queue)
-
 	return nil
 }
 
-type natsCluster struct {
-	conn []*provider.NATS
-	q map[string]string
-	log app.Logger
-}
+func (n *natsRepo) NewEvents(eventName string) (<-chan struct{}, error) {
+	queue, ok := n.q[eventName]
+	if !ok {
+		return nil, fmt.Errorf("Not found queue in nats for event %s", eventName)
+	}
 
-func msgID(clusterID int, sequenceID uint64) string {
-	return fmt.Sprintf("%d;%d", clusterID, sequenceID)
+	return n.conn.Notify(queue), nil
 }
 
-func parseMsgID(msgID string) (int, uint64, error) {
-	ind := strings.Index(msgID, ";")
-	if ind <= 0 {
-		return 0, 0, errors.New("Not an msgID")
+func (n *natsRepo) ConfirmAck(conf *app.TaskConfig, consumerName string) error {
+	queue, ok := n.q[conf.Name]
+	if !ok {
+		return fmt.Errorf("Not found queue in nats for event %s", conf.Name)
 	}
 
-	clusterID, err := strconv.ParseInt(msgID[:ind], 10, 64)
-	if err != nil {
-		return 0, 0, err
+	bySource, unknownErr := successfulIDs(conf, queue, 1)
+
+	if ids := bySource[0]; len(ids) > 0 {
+		if err := ackMessages(conf, n.conn, queue, ids); err != nil {
+			return err
+		}
 	}
 
-	sequenceID, err := strconv.ParseUint(msgID[ind+1:], 10, 64)
+	return unknownErr
+}
 
-	return int(clusterID), sequenceID, err
+type natsCluster struct {
+	conn []provider.Broker
+	q map[string]string
+	log app.Logger
+	//start is connection, which is read first by the next GetNew
+	start uint32
 }
 
 func (n *natsCluster) GetNew(conf *app.TaskConfig, consumerName string) error {
@@ -98,7 +176,7 @@ func (n *natsCluster) GetNew(conf *app.TaskConfig, consumerName string) error {
 		return fmt.Errorf("Not found queue in nats for event %s", conf.Name)
 	}
 
-	msgChan := make(chan map[string]*stan.Msg, len(n.conn))
+	msgsByConn := make([][]*provider.Message, len(n.conn))
 	errChan := make(chan error, len(n.conn))
 
 	parallelReaderWork := sync.WaitGroup{}
@@ -108,33 +186,24 @@ func (n *natsCluster) GetNew(conf *app.TaskConfig, consumerName string) error {
 		go func(connInd int) {
 			defer parallelReaderWork.Done()
 
-			indexedMsg, err := n.conn[connInd].GetMessages(queue)
+			msgs, err := n.conn[connInd].GetMessages(queue, conf.Limit())
 			if err != nil {
 				errChan <- fmt.Errorf("Reading from %s: %s", n.conn[connInd].Url(), err.Error())
 
 				return
 			}
 
-			resMsg := make(map[string]*stan.Msg, len(indexedMsg))
-
-			for seqID, msg := range indexedMsg {
-				resMsg[msgID(connInd, seqID)] = msg
-			}
-
-			msgChan <- resMsg
+			msgsByConn[connInd] = msgs
 		}(i)
 	}
 
 	parallelReaderWork.Wait()
 	close(errChan)
-	close(msgChan)
 
-	msgFromAllConn := make(map[string]*stan.Msg)
+	var msgCount int
 
-	for msg := range msgChan {
-		for id, m := range msg {
-			msgFromAllConn[id] = m
-		}
+	for i := range msgsByConn {
+		msgCount += len(msgsByConn[i])
 	}
 
 	var lastErr error
@@ -146,84 +215,99 @@ func (n *natsCluster) GetNew(conf *app.TaskConfig, consumerName string) error {
 		}
 	}
 
-	if lastErr != nil && len(msgFromAllConn) == 0 {
+	if lastErr != nil && msgCount == 0 {
 		return lastErr
 	}
 
-	conf.AllocateMemForEvents(len(msgFromAllConn))
+	conf.AllocateMemForEvents(msgCount)
 
-	for mID, msg := range msgFromAllConn {
-		conf.WriteEvent(mID, msg.Data)
+	if msgCount == 0 {
+		return nil
+	}
+
+	//Messages are taken from connections in turn, so backlog of one connection
+	//doesn't starve others. First connection is rotated between calls
+	first := int(atomic.AddUint32(&n.start, 1)-1) % len(msgsByConn)
+	limit := conf.Limit()
+
+	for i := 0; msgCount > 0; i++ {
+		for j := range msgsByConn {
+			connInd := (first + j) % len(msgsByConn)
+
+			if i >= len(msgsByConn[connInd]) {
+				continue
+			}
+
+			if limit > 0 && conf.Len() >= limit {
+				return nil
+			}
+
+			msg := msgsByConn[connInd][i]
+
+			conf.WriteEvent(MessageID{connInd, queue, msg.Sequence}, msg.Data)
+
+			msgCount--
+		}
 	}
 
 	return nil
 }
 
-func (n *natsCluster) ConfirmAck(conf *app.TaskConfig, consumerName string) error {
-	queue, ok := n.q[conf.Name]
+//NewEvents merges signals of all connections. Every call returns
+//own channel
+func (n *natsCluster) NewEvents(eventName string) (<-chan struct{}, error) {
+	queue, ok := n.q[eventName]
 	if !ok {
-		return fmt.Errorf("Not found queue in nats for event %s", conf.Name)
+		return nil, fmt.Errorf("Not found queue in nats for event %s", eventName)
 	}
 
-	ackResByConn := make(map[int][]uint64)
+	merged := make(chan struct{}, 1)
 
-	for id, err := range conf.ShowConsumigResult() {
-		if err != nil {
-			continue
-		}
-
-		connID, sequenceID, err := parseMsgID(id.(string))
-		if err != nil {
-			n.log.Error(fmt.Errorf("Unable to parse msg %s", id.(string)))
+	for i := range n.conn {
+		go func(ch <-chan struct{}) {
+			for range ch {
+				select {
+				case merged <- struct{}{}:
+				default:
+				}
+			}
+		}(n.conn[i].Notify(queue))
+	}
 
-			continue
-		}
+	return merged, nil
+}
 
-		ackResByConn[connID] = append(ackResByConn[connID], sequenceID)
+func (n *natsCluster) ConfirmAck(conf *app.TaskConfig, consumerName string) error {
+	queue, ok := n.q[conf.Name]
+	if !ok {
+		return fmt.Errorf("Not found queue in nats for event %s", conf.Name)
 	}
 
+	ackResByConn, unknownErr := successfulIDs(conf, queue, len(n.conn))
+
 	if len(ackResByConn) == 0 {
-		return nil
+		return unknownErr
 	}
 
 	parallelAck := sync.WaitGroup{}
 	parallelAck.Add(len(ackResByConn))
 
-	for srvID, seqIDs := range ackResByConn {
-		go func(serverID int, sequences []uint64) {
+	for srvID, ids := range ackResByConn {
+		go func(serverID int, ids []MessageID) {
 			defer parallelAck.Done()
 
-			rawMsg, err := n.conn[serverID].GetMessages(queue)
-			if err != nil {
-				n.log.Error(fmt.Errorf("Reading from %s: %s", n.conn[serverID].Url(), err.Error()))
-
-				return
+			if err := ackMessages(conf, n.conn[serverID], queue, ids); err != nil {
+				n.log.Error(err)
 			}
-
-			ackedMsg := make(map[uint64]*stan.Msg, len(sequences))
-
-			for i := range sequences {
-				if msg, ok := rawMsg[sequences[i]]; ok {
-					ackedMsg[sequences[i]] = msg
-				} else {
-					n.log.Error(fmt.Errorf("Not found msg with id %d in server %d", sequences[i]))
-				}
-			}
-
-			if len(ackedMsg) == 0 {
-				return
-			}
-
-			n.conn[serverID].Ack(ackedMsg, queue)
-		}(srvID, seqIDs)
+		}(srvID, ids)
 	}
 
 	parallelAck.Wait()
 
-	return nil
+	return unknownErr
 }
 
-func NewNatsCluster(q map[string]string, log app.Logger, conn ...*provider.NATS) *natsCluster {
+func NewNatsCluster(q map[string]string, log app.Logger, conn ...provider.Broker) *natsCluster {
 	return &natsCluster{
 		conn: conn,
 		q:    q,
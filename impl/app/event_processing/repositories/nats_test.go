@@ -0,0 +1,223 @@
+package repositories_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DmitriBeattie/custom-framework/impl/app/event_processing/codecs"
+	"github.com/DmitriBeattie/custom-framework/impl/app/event_processing/idempotency"
+	"github.com/DmitriBeattie/custom-framework/impl/app/event_processing/repositories"
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+	"github.com/DmitriBeattie/custom-framework/provider"
+)
+
+const (
+	eventName = "order"
+	subject   = "orders"
+)
+
+type order struct {
+	ID   int
+	Fail bool
+}
+
+//recordingConsumer remembers consumed orders and fails orders with Fail
+type recordingConsumer struct {
+	consumed []int
+}
+
+func (c *recordingConsumer) Name() string {
+	return "recorder"
+}
+
+func (c *recordingConsumer) Consume(conf *app.TaskConfig) error {
+	for _, id := range conf.EventIDs() {
+		var o order
+
+		if err := conf.GetEventAs(id, &o); err != nil {
+			conf.SetError(id, err)
+
+			continue
+		}
+
+		c.consumed = append(c.consumed, o.ID)
+
+		if o.Fail {
+			conf.SetError(id, errors.New("Order is rejected"))
+		}
+	}
+
+	return nil
+}
+
+type memorySink struct {
+	letters []app.DeadLetter
+}
+
+func (s *memorySink) Store(letter app.DeadLetter) error {
+	s.letters = append(s.letters, letter)
+
+	return nil
+}
+
+//lossyRepository loses the first acknowledgment, as if process
+//stopped after consuming
+type lossyRepository struct {
+	app.EventRepository
+	lost bool
+}
+
+func (r *lossyRepository) ConfirmAck(conf *app.TaskConfig, consumerName string) error {
+	if !r.lost {
+		r.lost = true
+
+		return nil
+	}
+
+	return r.EventRepository.ConfirmAck(conf, consumerName)
+}
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Info(msg interface{}, data ...interface{}) {
+	l.t.Log(msg)
+}
+
+func (l testLogger) Error(msg interface{}, data ...interface{}) {
+	l.t.Log(msg)
+}
+
+func newBroker(t *testing.T, ackWait time.Duration, payloads ...string) *provider.Memory {
+	b := provider.NewMemoryBroker(ackWait, 0)
+
+	if err := b.Subscribe(subject); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range payloads {
+		if err := b.Publish(subject, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return b
+}
+
+func process(t *testing.T, evp *app.EventProcessor) int {
+	received, err := evp.ProcessBatch(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return received
+}
+
+func TestNatsRepositoryDeadLetter(t *testing.T) {
+	b := newBroker(t, time.Minute, `{"ID":1}`, `{"ID":2,"Fail":true}`, `{"ID":3}`)
+	cons := &recordingConsumer{}
+	sink := &memorySink{}
+
+	evp := app.NewEventProcessor(repositories.NatsRepository(b, map[string]string{eventName: subject}), cons, eventName, app.WithoutAdapting, testLogger{t}).
+		WithDeadLetter(app.NewDeadLetterPolicy(2, sink, nil))
+
+	if received := process(t, evp); received != 3 {
+		t.Fatalf("Expected 3 events in first batch, got %d", received)
+	}
+
+	if pending := b.Pending(subject); pending != 1 {
+		t.Fatalf("Expected failed event to stay pending, got %d pending", pending)
+	}
+
+	if len(sink.letters) != 0 {
+		t.Fatalf("Expected no dead letters after first attempt, got %d", len(sink.letters))
+	}
+
+	if received := process(t, evp); received != 1 {
+		t.Fatalf("Expected 1 event in second batch, got %d", received)
+	}
+
+	if pending := b.Pending(subject); pending != 0 {
+		t.Fatalf("Expected dead-lettered event to be acknowledged, got %d pending", pending)
+	}
+
+	if len(sink.letters) != 1 || sink.letters[0].Attempts != 2 {
+		t.Fatalf("Expected one dead letter after 2 attempts, got %+v", sink.letters)
+	}
+
+	expected := []int{1, 2, 3, 2}
+	if len(cons.consumed) != len(expected) {
+		t.Fatalf("Expected consumed orders %v, got %v", expected, cons.consumed)
+	}
+
+	for i := range expected {
+		if cons.consumed[i] != expected[i] {
+			t.Fatalf("Expected consumed orders %v, got %v", expected, cons.consumed)
+		}
+	}
+}
+
+func TestNatsRepositoryIdempotency(t *testing.T) {
+	ackWait := 20 * time.Millisecond
+
+	b := newBroker(t, ackWait, `{"ID":1}`)
+	cons := &recordingConsumer{}
+	repo := &lossyRepository{EventRepository: repositories.NatsRepository(b, map[string]string{eventName: subject})}
+
+	evp := app.NewEventProcessor(repo, cons, eventName, app.WithoutAdapting, testLogger{t}).
+		WithIdempotency(idempotency.Memory(time.Minute))
+
+	process(t, evp)
+
+	if pending := b.Pending(subject); pending != 1 {
+		t.Fatalf("Expected event to stay pending after lost ack, got %d pending", pending)
+	}
+
+	time.Sleep(2 * ackWait)
+
+	if received := process(t, evp); received != 1 {
+		t.Fatalf("Expected redelivered event, got %d events", received)
+	}
+
+	if len(cons.consumed) != 1 {
+		t.Fatalf("Expected redelivered event to be skipped, consumed %v", cons.consumed)
+	}
+
+	if pending := b.Pending(subject); pending != 0 {
+		t.Fatalf("Expected redelivered event to be acknowledged, got %d pending", pending)
+	}
+}
+
+func TestNatsRepositoryBadInput(t *testing.T) {
+	b := newBroker(t, time.Minute, `not json`)
+	cons := &recordingConsumer{}
+	sink := &memorySink{}
+
+	reg := codecs.NewRegistry().Register(eventName, order{}, codecs.JSON)
+	repo := codecs.DecodingRepository(repositories.NatsRepository(b, map[string]string{eventName: subject}), reg)
+
+	evp := app.NewEventProcessor(repo, cons, eventName, app.WithoutAdapting, testLogger{t}).
+		WithDeadLetter(app.NewDeadLetterPolicy(1, sink, nil))
+
+	if received := process(t, evp); received != 1 {
+		t.Fatalf("Expected batch of bad event not to look empty, got %d events", received)
+	}
+
+	if len(cons.consumed) != 0 {
+		t.Fatalf("Expected bad event not to be consumed, consumed %v", cons.consumed)
+	}
+
+	if len(sink.letters) != 1 {
+		t.Fatalf("Expected bad event to be dead-lettered, got %d letters", len(sink.letters))
+	}
+
+	if payload, ok := sink.letters[0].Event.([]byte); !ok || string(payload) != "not json" {
+		t.Fatalf("Expected dead letter to keep raw payload, got %v", sink.letters[0].Event)
+	}
+
+	if pending := b.Pending(subject); pending != 0 {
+		t.Fatalf("Expected bad event to be acknowledged, got %d pending", pending)
+	}
+}
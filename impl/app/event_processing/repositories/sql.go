@@ -0,0 +1,323 @@
+package repositories
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+	"github.com/DmitriBeattie/custom-framework/provider"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	DefaultOutboxBatchSize = 100
+	DefaultOutboxLease     = time.Minute
+)
+
+//OutboxSchema describes outbox table and tables keeping state of consumers.
+//
+//Table should contain growing bigint id, event name and payload.
+//CursorTable keeps last confirmed id of every consumer and event:
+//consumer_name, event_name, last_id, locked_until.
+//ResultTable keeps acknowledgment results:
+//consumer_name, event_id, error, updated_at with unique key on
+//consumer_name and event_id
+type OutboxSchema struct {
+	Table           string
+	IDColumn        string
+	EventNameColumn string
+	PayloadColumn   string
+	CursorTable     string
+	ResultTable     string
+
+	//BatchSize is used when TaskConfig has no limit
+	BatchSize int
+
+	//Lease is time during which received batch is reserved for one
+	//replica. It expires if ConfirmAck is not called
+	Lease time.Duration
+}
+
+func (s OutboxSchema) withDefaults() OutboxSchema {
+	if s.IDColumn == "" {
+		s.IDColumn = "id"
+	}
+
+	if s.EventNameColumn == "" {
+		s.EventNameColumn = "event_name"
+	}
+
+	if s.PayloadColumn == "" {
+		s.PayloadColumn = "payload"
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = DefaultOutboxBatchSize
+	}
+
+	if s.Lease <= 0 {
+		s.Lease = DefaultOutboxLease
+	}
+
+	return s
+}
+
+type outboxQueries struct {
+	insertCursor string
+	lockCursor   string
+	leaseCursor  string
+	selectEvents func(limit int) string
+	upsertResult string
+	//upsertResultArgs orders arguments of upsertResult
+	upsertResultArgs func(consumerName string, eventID int64, errText *string, t time.Time) []interface{}
+	confirmCursor    string
+}
+
+type outboxBatchKey struct {
+	consumerName string
+}
+
+type outboxBatch struct {
+	ids    []int64
+	lastID int64
+}
+
+type sqlOutbox struct {
+	db *sqlx.DB
+	s  OutboxSchema
+	q  outboxQueries
+}
+
+func (o *sqlOutbox) selectEventsQuery(limitClause func(limit int) (top, tail string)) func(limit int) string {
+	return func(limit int) string {
+		top, tail := limitClause(limit)
+
+		return o.db.Rebind(fmt.Sprintf(
+			"SELECT %[1]s o.%[2]s, o.%[3]s FROM %[4]s o WHERE o.%[5]s = ? AND o.%[2]s > ? "+
+				"AND NOT EXISTS (SELECT 1 FROM %[6]s r WHERE r.consumer_name = ? AND r.event_id = o.%[2]s AND r.error IS NULL) "+
+				"ORDER BY o.%[2]s %[7]s",
+			top, o.s.IDColumn, o.s.PayloadColumn, o.s.Table, o.s.EventNameColumn, o.s.ResultTable, tail,
+		))
+	}
+}
+
+//PostgreSQLOutbox reads events from outbox table. Cursor rows are
+//claimed with FOR UPDATE SKIP LOCKED
+func PostgreSQLOutbox(db *provider.PostgreSQL, schema OutboxSchema) *sqlOutbox {
+	o := &sqlOutbox{
+		db: db.DB,
+		s:  schema.withDefaults(),
+	}
+
+	o.q = outboxQueries{
+		insertCursor: db.Rebind("INSERT INTO " + o.s.CursorTable + " (consumer_name, event_name, last_id) VALUES (?, ?, 0) ON CONFLICT DO NOTHING"),
+		lockCursor: db.Rebind("SELECT last_id, locked_until FROM " + o.s.CursorTable +
+			" WHERE consumer_name = ? AND event_name = ? FOR UPDATE SKIP LOCKED"),
+		leaseCursor: db.Rebind("UPDATE " + o.s.CursorTable + " SET locked_until = ? WHERE consumer_name = ? AND event_name = ?"),
+		selectEvents: o.selectEventsQuery(func(limit int) (string, string) {
+			return "", fmt.Sprintf("LIMIT %d", limit)
+		}),
+		upsertResult: db.Rebind("INSERT INTO " + o.s.ResultTable + " (consumer_name, event_id, error, updated_at) VALUES (?, ?, ?, ?) " +
+			"ON CONFLICT (consumer_name, event_id) DO UPDATE SET error = EXCLUDED.error, updated_at = EXCLUDED.updated_at"),
+		upsertResultArgs: func(consumerName string, eventID int64, errText *string, t time.Time) []interface{} {
+			return []interface{}{consumerName, eventID, errText, t}
+		},
+		confirmCursor: db.Rebind("UPDATE " + o.s.CursorTable + " SET last_id = ?, locked_until = NULL " +
+			"WHERE consumer_name = ? AND event_name = ? AND last_id < ?"),
+	}
+
+	return o
+}
+
+//MSSQLOutbox reads events from outbox table. Cursor rows are
+//claimed with UPDLOCK and READPAST hints
+func MSSQLOutbox(db *provider.MSSQL, schema OutboxSchema) *sqlOutbox {
+	o := &sqlOutbox{
+		db: db.DB,
+		s:  schema.withDefaults(),
+	}
+
+	o.q = outboxQueries{
+		insertCursor: db.Rebind("MERGE " + o.s.CursorTable + " WITH (HOLDLOCK) AS t " +
+			"USING (SELECT ? AS consumer_name, ? AS event_name) AS s " +
+			"ON t.consumer_name = s.consumer_name AND t.event_name = s.event_name " +
+			"WHEN NOT MATCHED THEN INSERT (consumer_name, event_name, last_id) VALUES (s.consumer_name, s.event_name, 0);"),
+		lockCursor: db.Rebind("SELECT last_id, locked_until FROM " + o.s.CursorTable +
+			" WITH (UPDLOCK, ROWLOCK, READPAST) WHERE consumer_name = ? AND event_name = ?"),
+		leaseCursor: db.Rebind("UPDATE " + o.s.CursorTable + " SET locked_until = ? WHERE consumer_name = ? AND event_name = ?"),
+		selectEvents: o.selectEventsQuery(func(limit int) (string, string) {
+			return fmt.Sprintf("TOP (%d)", limit), ""
+		}),
+		upsertResult: db.Rebind("MERGE " + o.s.ResultTable + " WITH (HOLDLOCK) AS t " +
+			"USING (SELECT ? AS consumer_name, ? AS event_id) AS s " +
+			"ON t.consumer_name = s.consumer_name AND t.event_id = s.event_id " +
+			"WHEN MATCHED THEN UPDATE SET error = ?, updated_at = ? " +
+			"WHEN NOT MATCHED THEN INSERT (consumer_name, event_id, error, updated_at) VALUES (s.consumer_name, s.event_id, ?, ?);"),
+		upsertResultArgs: func(consumerName string, eventID int64, errText *string, t time.Time) []interface{} {
+			return []interface{}{consumerName, eventID, errText, t, errText, t}
+		},
+		confirmCursor: db.Rebind("UPDATE " + o.s.CursorTable + " SET last_id = ?, locked_until = NULL " +
+			"WHERE consumer_name = ? AND event_name = ? AND last_id < ?"),
+	}
+
+	return o
+}
+
+func (o *sqlOutbox) ensureCursor(eventName, consumerName string) error {
+	_, err := o.db.Exec(o.q.insertCursor, consumerName, eventName)
+
+	return err
+}
+
+func (o *sqlOutbox) GetNew(conf *app.TaskConfig, consumerName string) error {
+	if err := o.ensureCursor(conf.Name, consumerName); err != nil {
+		return fmt.Errorf("Unable to create cursor of %s for event %s: %s", consumerName, conf.Name, err)
+	}
+
+	tx, err := o.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var lastID int64
+	var lockedUntil *time.Time
+
+	if err := tx.QueryRowx(o.q.lockCursor, consumerName, conf.Name).Scan(&lastID, &lockedUntil); err != nil {
+		if err == sql.ErrNoRows {
+			//Cursor is claimed by another replica
+			return nil
+		}
+
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	if lockedUntil != nil && lockedUntil.After(now) {
+		return nil
+	}
+
+	limit := conf.Limit()
+	if limit <= 0 {
+		limit = o.s.BatchSize
+	}
+
+	type outboxEvent struct {
+		id      int64
+		payload []byte
+	}
+
+	var events []outboxEvent
+
+	rows, err := tx.Query(o.q.selectEvents(limit), conf.Name, lastID, consumerName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ev outboxEvent
+
+		if err := rows.Scan(&ev.id, &ev.payload); err != nil {
+			return err
+		}
+
+		events = append(events, ev)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		return tx.Commit()
+	}
+
+	if _, err := tx.Exec(o.q.leaseCursor, now.Add(o.s.Lease), consumerName, conf.Name); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	batch := outboxBatch{
+		ids:    make([]int64, 0, len(events)),
+		lastID: lastID,
+	}
+
+	conf.AllocateMemForEvents(len(events))
+
+	for i := range events {
+		batch.ids = append(batch.ids, events[i].id)
+
+		conf.WriteEvent(events[i].id, events[i].payload)
+	}
+
+	conf.WriteCtx(outboxBatchKey{consumerName}, batch)
+
+	return nil
+}
+
+//ConfirmAck writes results of all events and moves cursor to the last
+//event, which is acknowledged together with all previous events
+func (o *sqlOutbox) ConfirmAck(conf *app.TaskConfig, consumerName string) error {
+	ackResult := conf.ShowConsumigResult()
+
+	batch, ok := conf.GetContext(outboxBatchKey{consumerName}).(outboxBatch)
+	if !ok {
+		for id := range ackResult {
+			if eventID, isInt := id.(int64); isInt {
+				batch.ids = append(batch.ids, eventID)
+			} else {
+				conf.SetError(id, fmt.Errorf("Outbox event id should be int64, got %T", id))
+			}
+		}
+
+		sort.Slice(batch.ids, func(i, j int) bool { return batch.ids[i] < batch.ids[j] })
+	}
+
+	tx, err := o.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+
+	newLastID := batch.lastID
+	isPrefixConfirmed := true
+
+	for _, eventID := range batch.ids {
+		var errText *string
+
+		if ackErr := ackResult[eventID]; ackErr != nil {
+			text := ackErr.Error()
+			errText = &text
+
+			isPrefixConfirmed = false
+		} else if isPrefixConfirmed {
+			newLastID = eventID
+		}
+
+		if _, err := tx.Exec(o.q.upsertResult, o.q.upsertResultArgs(consumerName, eventID, errText, now)...); err != nil {
+			return fmt.Errorf("Unable to save result of event %d: %s", eventID, err)
+		}
+	}
+
+	if _, err := tx.Exec(o.q.confirmCursor, newLastID, consumerName, conf.Name, newLastID); err != nil {
+		return err
+	}
+
+	//Lease is released even if cursor is not moved
+	if newLastID == batch.lastID {
+		if _, err := tx.Exec(o.q.leaseCursor, nil, consumerName, conf.Name); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -1,9 +1,13 @@
 package app
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 	"sync"
+	"time"
 )
 
 type dependencyID string
@@ -27,77 +31,360 @@ type Instance interface {
 	DependsOn() []string
 }
 
+//ContextInstance is an Instance which is able to stop its work
+//when ctx is done
+type ContextInstance interface {
+	Instance
+	ProcessContext(ctx context.Context, data interface{}) error
+}
+
+//InstanceTimeout is implemented by instances which have to be
+//interrupted after Timeout
+type InstanceTimeout interface {
+	Timeout() time.Duration
+}
+
+type timeoutInstance struct {
+	Instance
+	d time.Duration
+}
+
+//WithTimeout limits execution time of inst by d
+func WithTimeout(inst Instance, d time.Duration) Instance {
+	return &timeoutInstance{
+		Instance: inst,
+		d:        d,
+	}
+}
+
+func (t *timeoutInstance) ProcessData(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.d)
+	defer cancel()
+
+	return processInstance(ctx, t.Instance, data, in)
+}
+
+//Inputs contains outputs of parent instances by their names
+type Inputs map[string]interface{}
+
+//Assign copies output of parent instance to the value pointed by dst
+func (in Inputs) Assign(parentName string, dst interface{}) error {
+	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() != reflect.Ptr || dstVal.IsNil() {
+		return errors.New("Destination is not a pointer")
+	}
+
+	out, ok := in[parentName]
+	if !ok {
+		return fmt.Errorf("Not found output of instance %s", parentName)
+	}
+
+	if out == nil {
+		dstVal.Elem().Set(reflect.Zero(dstVal.Elem().Type()))
+
+		return nil
+	}
+
+	outVal := reflect.ValueOf(out)
+	if !outVal.Type().AssignableTo(dstVal.Elem().Type()) {
+		return fmt.Errorf("Output of instance %s has type %s, which is not assignable to %s", parentName, outVal.Type(), dstVal.Elem().Type())
+	}
+
+	dstVal.Elem().Set(outVal)
+
+	return nil
+}
+
+//DataInstance receives outputs of its parents and passes
+//its own output to dependants
+type DataInstance interface {
+	Instance
+	ProcessData(ctx context.Context, data interface{}, in Inputs) (interface{}, error)
+}
+
+type InstanceFunc func(ctx context.Context, data interface{}, in Inputs) (interface{}, error)
+
+type funcInstance struct {
+	f         InstanceFunc
+	name      string
+	dependsOn []string
+}
+
+//NewInstance creates DataInstance from f
+func NewInstance(name string, f InstanceFunc, dependsOn ...string) DataInstance {
+	return &funcInstance{
+		f:         f,
+		name:      name,
+		dependsOn: dependsOn,
+	}
+}
+
+func (f *funcInstance) Name() string {
+	return f.name
+}
+
+func (f *funcInstance) DependsOn() []string {
+	return f.dependsOn
+}
+
+func (f *funcInstance) Process(data interface{}) error {
+	_, err := f.f(context.Background(), data, Inputs{})
+
+	return err
+}
+
+func (f *funcInstance) ProcessData(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+	return f.f(ctx, data, in)
+}
+
+//NotProcessedError contains reasons why instances were not run
+type NotProcessedError map[string]error
+
+func (e NotProcessedError) Error() string {
+	names := make([]string, 0, len(e))
+
+	for name := range e {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var errMsg string
+
+	for _, name := range names {
+		errMsg += fmt.Sprintf("Instance %s was not processed: %s\n", name, e[name])
+	}
+
+	return errMsg
+}
+
+//InstanceStatus describes result of instance processing
+type InstanceStatus uint8
+
+const (
+	InstanceSucceeded InstanceStatus = iota
+	InstanceFailed
+	//InstanceSkipped means that one of parents was not succeeded
+	InstanceSkipped
+	//InstanceCancelled means that context was done before instance started
+	InstanceCancelled
+	//InstanceOmitted means that instance decided not to run. Its
+	//dependants are processed as if it was succeeded
+	InstanceOmitted
+)
+
+//ErrInstanceOmitted is returned by instance, which doesn't need to run
+var ErrInstanceOmitted = errors.New("Instance omitted")
+
+//abandonedError is returned when waiting for instance, which is not
+//aware of context, is interrupted. Its call is still running
+type abandonedError struct {
+	name string
+	err  error
+}
+
+func (e *abandonedError) Error() string {
+	return fmt.Sprintf("Instance %s was interrupted: %s", e.name, e.err)
+}
+
+func (e *abandonedError) Unwrap() error {
+	return e.err
+}
+
+func (s InstanceStatus) String() string {
+	switch s {
+	case InstanceSucceeded:
+		return "succeeded"
+	case InstanceFailed:
+		return "failed"
+	case InstanceSkipped:
+		return "skipped"
+	case InstanceCancelled:
+		return "cancelled"
+	case InstanceOmitted:
+		return "omitted"
+	default:
+		return fmt.Sprintf("unknown status %d", s)
+	}
+}
+
+//InstanceReport contains result of single instance processing
+type InstanceReport struct {
+	Name     string
+	Status   InstanceStatus
+	Duration time.Duration
+	Err      error
+	Output   interface{}
+	Attempts int
+}
+
+//Report contains results of all aggregator instances in
+//the order they were passed to NewAggregator
+type Report []InstanceReport
+
+func (r Report) Get(name string) (InstanceReport, bool) {
+	for i := range r {
+		if r[i].Name == name {
+			return r[i], true
+		}
+	}
+
+	return InstanceReport{}, false
+}
+
+//Output returns output of succeeded instance
+func (r Report) Output(name string) (interface{}, bool) {
+	res, ok := r.Get(name)
+	if !ok || res.Status != InstanceSucceeded {
+		return nil, false
+	}
+
+	return res.Output, true
+}
+
+//WithStatus returns reports of instances finished with one of statuses
+func (r Report) WithStatus(statuses ...InstanceStatus) Report {
+	var res Report
+
+	for i := range r {
+		for _, st := range statuses {
+			if r[i].Status == st {
+				res = append(res, r[i])
+
+				break
+			}
+		}
+	}
+
+	return res
+}
+
+//IsSucceeded reports whether all instances were succeeded or omitted
+func (r Report) IsSucceeded() bool {
+	for i := range r {
+		if r[i].Status != InstanceSucceeded && r[i].Status != InstanceOmitted {
+			return false
+		}
+	}
+
+	return true
+}
+
+//Err describes all instances which were neither succeeded nor omitted
+func (r Report) Err() error {
+	if r.IsSucceeded() {
+		return nil
+	}
+
+	var errMsg string
+
+	for i := range r {
+		if r[i].Status != InstanceSucceeded && r[i].Status != InstanceOmitted {
+			errMsg += fmt.Sprintf("Instance %s %s: %s\n", r[i].Name, r[i].Status, r[i].Err)
+		}
+	}
+
+	return errors.New(errMsg)
+}
+
+type notification struct {
+	from   string
+	status InstanceStatus
+	err    error
+	output interface{}
+}
+
 type dependency struct {
 	parentInstanceName string
 	childInstanceName  string
 }
 
 type Aggregator struct {
-	instances []Instance
-	dep       map[dependencyID]dependency
-	log       Logger
+	instances      []Instance
+	dep            map[dependencyID]dependency
+	log            Logger
+	maxParallelism int
+	defaultPolicy  FailurePolicy
+	policies       map[string]FailurePolicy
+	retries        map[string]RetryPolicy
+	layers         [][]string
 }
 
 func NewAggregator(log Logger, instances ...Instance) (*Aggregator, error) {
-	//return nil, errors.New("Need to be implemented")
-
 	agr := &Aggregator{
 		instances: instances,
 		dep:       make(map[dependencyID]dependency),
 		log:       log,
+		policies:  make(map[string]FailurePolicy),
+		retries:   make(map[string]RetryPolicy),
 	}
 
 	nodes := make(map[string]bool, len(instances))
 
 	for _, inst := range instances {
+		if _, isDuplicate := nodes[inst.Name()]; isDuplicate {
+			return nil, fmt.Errorf("Instance %s is registered more than once", inst.Name())
+		}
+
 		nodes[inst.Name()] = false
 	}
 
-	processedNodes := 0
-	for {
-		if processedNodes == len(nodes) {
-			break
+	for _, inst := range instances {
+		for _, dependsOn := range inst.DependsOn() {
+			if _, isParentInstanceExists := nodes[dependsOn]; !isParentInstanceExists {
+				return nil, MissingDependencyError{Instance: inst.Name(), DependsOn: dependsOn}
+			}
+
+			id, dep := createDependency(dependsOn, inst.Name())
+			agr.dep[id] = dep
 		}
+	}
 
-		newProcessedNodes := processedNodes
+	for processedNodes := 0; processedNodes < len(instances); {
+		var layer []string
 
 		for _, inst := range instances {
+			if nodes[inst.Name()] {
+				continue
+			}
+
 			isDependFromNotProcessedNode := false
+
 			for _, dependsOn := range inst.DependsOn() {
-				isParentInstanceProcessed, isParentInstanceExists := nodes[dependsOn]
-				if !isParentInstanceExists {
-					return nil, fmt.Errorf("%s not found", dependsOn)
-				}
-				if isParentInstanceProcessed {
-					id, dep := createDependency(dependsOn, inst.Name())
-					agr.dep[id] = dep
-				} else {
+				if !nodes[dependsOn] {
 					isDependFromNotProcessedNode = true
+
+					break
 				}
 			}
 
 			if !isDependFromNotProcessedNode {
-				newProcessedNodes++
-				nodes[inst.Name()] = true
+				layer = append(layer, inst.Name())
 			}
 		}
 
-		if newProcessedNodes == processedNodes {
-			return nil, errors.New("Unable to build aggregator. Check if cycles or unreachable dependencies exists")
+		if len(layer) == 0 {
+			return nil, CycleError{Path: findCycle(instances, nodes)}
 		}
 
-		processedNodes = newProcessedNodes
+		for _, name := range layer {
+			nodes[name] = true
+		}
+
+		processedNodes += len(layer)
+
+		agr.layers = append(agr.layers, layer)
 	}
 
 	return agr, nil
 }
 
-func (a *Aggregator) pipeline() (listeners, notifiers map[string][]chan error) {
-	listeners = make(map[string][]chan error, len(a.dep))
-	notifiers = make(map[string][]chan error, len(a.dep))
+func (a *Aggregator) pipeline() (listeners, notifiers map[string][]chan notification) {
+	listeners = make(map[string][]chan notification, len(a.dep))
+	notifiers = make(map[string][]chan notification, len(a.dep))
 
 	for _, dep := range a.dep {
-		ch := make(chan error, 1)
+		ch := make(chan notification, 1)
 		listeners[dep.childInstanceName] = append(listeners[dep.childInstanceName], ch)
 		notifiers[dep.parentInstanceName] = append(notifiers[dep.parentInstanceName], ch)
 	}
@@ -105,49 +392,215 @@ func (a *Aggregator) pipeline() (listeners, notifiers map[string][]chan error) {
 	return
 }
 
-func (a *Aggregator) Process(data interface{}) {
+//Process runs all instances without any deadline
+func (a *Aggregator) Process(data interface{}) Report {
+	report, _ := a.ProcessContext(context.Background(), data)
+
+	return report
+}
+
+//ProcessContext runs all instances until ctx is done. Instances which
+//were never run are also returned in NotProcessedError
+func (a *Aggregator) ProcessContext(ctx context.Context, data interface{}) (Report, error) {
+	return a.process(ctx, data, nil)
+}
+
+//process passes external inputs to every instance in addition to
+//outputs of its parents
+func (a *Aggregator) process(ctx context.Context, data interface{}, external Inputs) (Report, error) {
 	list, ntf := a.pipeline()
 
+	report := make(Report, len(a.instances))
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var failFastErr error
+	failFastOnce := sync.Once{}
+
+	failFast := func(instanceName string, err error) {
+		failFastOnce.Do(func() {
+			failFastErr = fmt.Errorf("Instance %s failed: %s", instanceName, err)
+
+			cancel()
+		})
+	}
+
+	cancelReason := func() error {
+		if ctx.Err() == nil && failFastErr != nil {
+			return failFastErr
+		}
+
+		return runCtx.Err()
+	}
+
+	var sem chan struct{}
+	if a.maxParallelism > 0 {
+		sem = make(chan struct{}, a.maxParallelism)
+	}
+
 	instanceWg := sync.WaitGroup{}
 	instanceWg.Add(len(a.instances))
 
 	for i := range a.instances {
-		go func(inst Instance) {
+		go func(ind int, inst Instance) {
 			defer instanceWg.Done()
 
-			var parentError error
+			res := &report[ind]
+			res.Name = inst.Name()
 
-			if chz, ok := list[inst.Name()]; ok {
-				wait := sync.WaitGroup{}
-				wait.Add(len(chz))
+			in := make(Inputs, len(list[inst.Name()])+len(external))
 
-				for j := range chz {
-					go func(ind int) {
-						defer wait.Done()
+			for name, out := range external {
+				in[name] = out
+			}
 
-						err := <-chz[ind]
-						if err != nil {
-							parentError = err
-						}
-					}(j)
+			for _, ch := range list[inst.Name()] {
+				if res.Err != nil {
+					break
 				}
 
-				wait.Wait()
+				select {
+				case parent := <-ch:
+					if parent.status == InstanceSucceeded {
+						in[parent.from] = parent.output
+					} else if parent.status == InstanceOmitted {
+						delete(in, parent.from)
+					} else if parent.status != InstanceFailed || a.failurePolicy(parent.from) != ContinueOnFailure {
+						res.Status = InstanceSkipped
+						res.Err = fmt.Errorf("Parent instance %s %s: %s", parent.from, parent.status, parent.err)
+					}
+				case <-runCtx.Done():
+					res.Status = InstanceCancelled
+					res.Err = cancelReason()
+				}
 			}
 
-			if parentError == nil {
-				if err := inst.Process(data); err != nil {
-					parentError = err
-					a.log.Error(err)
+			if res.Err == nil && sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-runCtx.Done():
+				}
+			}
+
+			if res.Err == nil && runCtx.Err() != nil {
+				res.Status = InstanceCancelled
+				res.Err = cancelReason()
+			}
+
+			if res.Err == nil {
+				start := time.Now()
+
+				res.Output, res.Attempts, res.Err = a.runWithRetries(runCtx, inst, data, in)
+				res.Duration = time.Since(start)
+
+				if errors.Is(res.Err, ErrInstanceOmitted) {
+					res.Status = InstanceOmitted
+					res.Output = nil
+					res.Err = nil
+				} else if res.Err != nil {
+					res.Status = InstanceFailed
+					res.Output = nil
+
+					a.log.Error(res.Err)
+
+					if a.failurePolicy(inst.Name()) == FailFast {
+						failFast(inst.Name(), res.Err)
+					}
+				} else {
+					res.Status = InstanceSucceeded
 				}
 			}
 
 			for _, notify := range ntf[inst.Name()] {
-				notify <- parentError
+				notify <- notification{from: inst.Name(), status: res.Status, err: res.Err, output: res.Output}
 				close(notify)
 			}
-		}(a.instances[i])
+		}(i, a.instances[i])
 	}
 
 	instanceWg.Wait()
+
+	npErr := NotProcessedError{}
+
+	for i := range report {
+		if report[i].Status == InstanceSkipped || report[i].Status == InstanceCancelled {
+			npErr[report[i].Name] = report[i].Err
+		}
+	}
+
+	if len(npErr) == 0 {
+		return report, nil
+	}
+
+	return report, npErr
+}
+
+func (a *Aggregator) runWithRetries(ctx context.Context, inst Instance, data interface{}, in Inputs) (out interface{}, attempts int, err error) {
+	retry := a.retryPolicy(inst.Name())
+	backoff := retry.Backoff
+
+	for attempts < retry.Attempts {
+		attempts++
+
+		out, err = a.runInstance(ctx, inst, data, in)
+		if err == nil || attempts == retry.Attempts || errors.Is(err, ErrInstanceOmitted) {
+			break
+		}
+
+		//Abandoned call keeps running, so retry would run instance concurrently with it
+		var abandoned *abandonedError
+		if errors.As(err, &abandoned) {
+			break
+		}
+
+		a.log.Info(fmt.Sprintf("Attempt %d of %s failed: %s", attempts, inst.Name(), err))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, attempts, err
+		}
+
+		backoff *= 2
+	}
+
+	return out, attempts, err
+}
+
+func (a *Aggregator) runInstance(ctx context.Context, inst Instance, data interface{}, in Inputs) (interface{}, error) {
+	if t, ok := inst.(InstanceTimeout); ok && t.Timeout() > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout())
+		defer cancel()
+	}
+
+	return processInstance(ctx, inst, data, in)
+}
+
+//processInstance interrupts waiting for instances which are not
+//aware of context
+func processInstance(ctx context.Context, inst Instance, data interface{}, in Inputs) (interface{}, error) {
+	if dataInst, ok := inst.(DataInstance); ok {
+		return dataInst.ProcessData(ctx, data, in)
+	}
+
+	if ctxInst, ok := inst.(ContextInstance); ok {
+		return nil, ctxInst.ProcessContext(ctx, data)
+	}
+
+	res := make(chan error, 1)
+
+	go func() {
+		res <- inst.Process(data)
+	}()
+
+	select {
+	case err := <-res:
+		return nil, err
+	case <-ctx.Done():
+		return nil, &abandonedError{inst.Name(), ctx.Err()}
+	}
 }
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//Predicate decides whether instance has to be run
+type Predicate func(data interface{}, in Inputs) bool
+
+type conditionalInstance struct {
+	Instance
+	p Predicate
+}
+
+//When runs inst only if p returns true. Otherwise inst is omitted
+//and its dependants are run without its output
+func When(inst Instance, p Predicate) Instance {
+	return &conditionalInstance{
+		Instance: inst,
+		p:        p,
+	}
+}
+
+//Timeout forwards timeout of wrapped instance
+func (c *conditionalInstance) Timeout() time.Duration {
+	if t, ok := c.Instance.(InstanceTimeout); ok {
+		return t.Timeout()
+	}
+
+	return 0
+}
+
+func (c *conditionalInstance) ProcessData(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+	if !c.p(data, in) {
+		return nil, ErrInstanceOmitted
+	}
+
+	return processInstance(ctx, c.Instance, data, in)
+}
+
+type nestedAggregator struct {
+	agr       *Aggregator
+	name      string
+	dependsOn []string
+}
+
+//AsInstance allows to use aggregator inside another aggregator.
+//Outputs of parents are passed to every nested instance and
+//outputs of nested instances without dependants are returned as Inputs
+func (a *Aggregator) AsInstance(name string, dependsOn ...string) DataInstance {
+	return &nestedAggregator{
+		agr:       a,
+		name:      name,
+		dependsOn: dependsOn,
+	}
+}
+
+func (n *nestedAggregator) Name() string {
+	return n.name
+}
+
+func (n *nestedAggregator) DependsOn() []string {
+	return n.dependsOn
+}
+
+func (n *nestedAggregator) Process(data interface{}) error {
+	_, err := n.ProcessData(context.Background(), data, Inputs{})
+
+	return err
+}
+
+func (n *nestedAggregator) ProcessData(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+	report, _ := n.agr.process(ctx, data, in)
+
+	if err := report.Err(); err != nil {
+		return nil, fmt.Errorf("Nested aggregator %s: %s", n.name, err)
+	}
+
+	hasDependants := make(map[string]bool, len(n.agr.dep))
+
+	for _, dep := range n.agr.dep {
+		hasDependants[dep.parentInstanceName] = true
+	}
+
+	out := Inputs{}
+
+	for i := range report {
+		if !hasDependants[report[i].Name] && report[i].Status == InstanceSucceeded {
+			out[report[i].Name] = report[i].Output
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//MissingDependencyError is returned when instance depends on
+//instance which was not passed to aggregator
+type MissingDependencyError struct {
+	Instance  string
+	DependsOn string
+}
+
+func (e MissingDependencyError) Error() string {
+	return fmt.Sprintf("Instance %s depends on %s, which is not found", e.Instance, e.DependsOn)
+}
+
+//CycleError contains instances forming a cycle. The first
+//instance is repeated at the end of Path
+type CycleError struct {
+	Path []string
+}
+
+func (e CycleError) Error() string {
+	return "Unable to build aggregator. Cycle found: " + strings.Join(e.Path, " -> ")
+}
+
+//findCycle searches for a cycle among instances which were not
+//placed to any layer
+func findCycle(instances []Instance, processed map[string]bool) []string {
+	byName := make(map[string]Instance, len(instances))
+
+	for _, inst := range instances {
+		byName[inst.Name()] = inst
+	}
+
+	const (
+		notVisited = iota
+		inPath
+		visited
+	)
+
+	state := make(map[string]int, len(instances))
+
+	var path []string
+
+	var visit func(name string) []string
+
+	visit = func(name string) []string {
+		state[name] = inPath
+		path = append(path, name)
+
+		for _, parent := range byName[name].DependsOn() {
+			if processed[parent] {
+				continue
+			}
+
+			switch state[parent] {
+			case inPath:
+				for i := range path {
+					if path[i] == parent {
+						cycle := append([]string{}, path[i:]...)
+
+						return append(cycle, parent)
+					}
+				}
+			case notVisited:
+				if cycle := visit(parent); cycle != nil {
+					return cycle
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[name] = visited
+
+		return nil
+	}
+
+	for _, inst := range instances {
+		if processed[inst.Name()] || state[inst.Name()] != notVisited {
+			continue
+		}
+
+		if cycle := visit(inst.Name()); cycle != nil {
+			//Path is built from child to parent
+			for i, j := 0, len(cycle)-1; i < j; i, j = i+1, j-1 {
+				cycle[i], cycle[j] = cycle[j], cycle[i]
+			}
+
+			return cycle
+		}
+	}
+
+	return nil
+}
+
+//Layers returns instance names grouped by topological layers.
+//Instances of a layer depend only on instances of previous layers
+func (a *Aggregator) Layers() [][]string {
+	layers := make([][]string, len(a.layers))
+
+	for i := range a.layers {
+		layers[i] = append([]string{}, a.layers[i]...)
+	}
+
+	return layers
+}
+
+//Dependencies returns names of instances which instance depends on
+func (a *Aggregator) Dependencies(instanceName string) []string {
+	for _, inst := range a.instances {
+		if inst.Name() == instanceName {
+			return append([]string{}, inst.DependsOn()...)
+		}
+	}
+
+	return nil
+}
+
+func (a *Aggregator) edges(f func(parent, child string)) {
+	for _, inst := range a.instances {
+		seen := make(map[string]bool, len(inst.DependsOn()))
+
+		for _, parent := range inst.DependsOn() {
+			if seen[parent] {
+				continue
+			}
+
+			seen[parent] = true
+
+			f(parent, inst.Name())
+		}
+	}
+}
+
+//DOT describes graph in Graphviz format
+func (a *Aggregator) DOT() string {
+	b := strings.Builder{}
+
+	b.WriteString("digraph aggregator {\n")
+
+	for _, inst := range a.instances {
+		b.WriteString("\t" + strconv.Quote(inst.Name()) + ";\n")
+	}
+
+	a.edges(func(parent, child string) {
+		b.WriteString("\t" + strconv.Quote(parent) + " -> " + strconv.Quote(child) + ";\n")
+	})
+
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+//Mermaid describes graph as Mermaid flowchart
+func (a *Aggregator) Mermaid() string {
+	ids := make(map[string]string, len(a.instances))
+
+	b := strings.Builder{}
+
+	b.WriteString("graph TD\n")
+
+	for i, inst := range a.instances {
+		ids[inst.Name()] = fmt.Sprintf("n%d", i)
+
+		label := strings.Replace(inst.Name(), `"`, "#quot;", -1)
+
+		b.WriteString(fmt.Sprintf("\t%s[\"%s\"]\n", ids[inst.Name()], label))
+	}
+
+	a.edges(func(parent, child string) {
+		b.WriteString(fmt.Sprintf("\t%s --> %s\n", ids[parent], ids[child]))
+	})
+
+	return b.String()
+}
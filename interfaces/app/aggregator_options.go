@@ -0,0 +1,120 @@
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+//FailurePolicy defines what happens with the graph when instance fails
+type FailurePolicy uint8
+
+const (
+	//SkipDescendants doesn't run instances depending on failed one
+	SkipDescendants FailurePolicy = iota
+	//FailFast cancels processing of the whole graph
+	FailFast
+	//ContinueOnFailure runs dependants as if instance was succeeded.
+	//Output of failed instance is not passed to them
+	ContinueOnFailure
+)
+
+//RetryPolicy describes how many times instance is run until
+//it succeeds. Delay between attempts doubles starting from Backoff
+type RetryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+type AggregatorOption func(a *Aggregator)
+
+//MaxParallelism limits count of simultaneously running instances
+func MaxParallelism(n int) AggregatorOption {
+	return func(a *Aggregator) {
+		a.maxParallelism = n
+	}
+}
+
+//DefaultFailurePolicy is applied to instances without own policy
+func DefaultFailurePolicy(p FailurePolicy) AggregatorOption {
+	return func(a *Aggregator) {
+		a.defaultPolicy = p
+	}
+}
+
+func InstanceFailurePolicy(instanceName string, p FailurePolicy) AggregatorOption {
+	return func(a *Aggregator) {
+		a.policies[instanceName] = p
+	}
+}
+
+//InstanceRetry repeats failed instance up to attempts times. Instance,
+//which is not aware of context, is not repeated after timeout, because
+//its interrupted call is still running
+func InstanceRetry(instanceName string, attempts int, backoff time.Duration) AggregatorOption {
+	return func(a *Aggregator) {
+		a.retries[instanceName] = RetryPolicy{
+			Attempts: attempts,
+			Backoff:  backoff,
+		}
+	}
+}
+
+//NewAggregatorWithOptions creates aggregator and applies opts to it
+func NewAggregatorWithOptions(log Logger, opts []AggregatorOption, instances ...Instance) (*Aggregator, error) {
+	agr, err := NewAggregator(log, instances...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		opt(agr)
+	}
+
+	if agr.maxParallelism < 0 {
+		return nil, fmt.Errorf("Max parallelism can't be negative: %d", agr.maxParallelism)
+	}
+
+	for name := range agr.policies {
+		if !agr.hasInstance(name) {
+			return nil, fmt.Errorf("Failure policy is set for unknown instance %s", name)
+		}
+	}
+
+	for name, r := range agr.retries {
+		if !agr.hasInstance(name) {
+			return nil, fmt.Errorf("Retry policy is set for unknown instance %s", name)
+		}
+
+		if r.Attempts < 1 {
+			return nil, fmt.Errorf("Retry policy of %s should have at least one attempt", name)
+		}
+	}
+
+	return agr, nil
+}
+
+func (a *Aggregator) hasInstance(name string) bool {
+	for i := range a.instances {
+		if a.instances[i].Name() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *Aggregator) failurePolicy(instanceName string) FailurePolicy {
+	if p, ok := a.policies[instanceName]; ok {
+		return p
+	}
+
+	return a.defaultPolicy
+}
+
+func (a *Aggregator) retryPolicy(instanceName string) RetryPolicy {
+	if r, ok := a.retries[instanceName]; ok {
+		return r
+	}
+
+	return RetryPolicy{Attempts: 1}
+}
@@ -0,0 +1,280 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type silentLogger struct{}
+
+func (silentLogger) Info(msg interface{}, data ...interface{})  {}
+func (silentLogger) Error(msg interface{}, data ...interface{}) {}
+
+//blockingInstance is not aware of context and counts simultaneous calls
+type blockingInstance struct {
+	name    string
+	timeout time.Duration
+	delay   time.Duration
+	calls   int32
+	running int32
+	maxRun  int32
+}
+
+func (b *blockingInstance) Name() string {
+	return b.name
+}
+
+func (b *blockingInstance) DependsOn() []string {
+	return nil
+}
+
+func (b *blockingInstance) Timeout() time.Duration {
+	return b.timeout
+}
+
+func (b *blockingInstance) Process(data interface{}) error {
+	atomic.AddInt32(&b.calls, 1)
+
+	running := atomic.AddInt32(&b.running, 1)
+	defer atomic.AddInt32(&b.running, -1)
+
+	for {
+		maxRun := atomic.LoadInt32(&b.maxRun)
+		if running <= maxRun || atomic.CompareAndSwapInt32(&b.maxRun, maxRun, running) {
+			break
+		}
+	}
+
+	time.Sleep(b.delay)
+
+	return nil
+}
+
+func newAggregator(t *testing.T, opts []AggregatorOption, instances ...Instance) *Aggregator {
+	agr, err := NewAggregatorWithOptions(silentLogger{}, opts, instances...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return agr
+}
+
+func assertStatus(t *testing.T, report Report, name string, status InstanceStatus) InstanceReport {
+	res, ok := report.Get(name)
+	if !ok {
+		t.Fatalf("Instance %s is not in report", name)
+	}
+
+	if res.Status != status {
+		t.Fatalf("Expected instance %s to be %s, got %s: %v", name, status, res.Status, res.Err)
+	}
+
+	return res
+}
+
+func TestAggregatorReport(t *testing.T) {
+	var flakyCalls int32
+
+	source := NewInstance("source", func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+		return data.(int) * 2, nil
+	})
+
+	flaky := NewInstance("flaky", func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+		if atomic.AddInt32(&flakyCalls, 1) < 3 {
+			return nil, errors.New("Not yet")
+		}
+
+		return nil, nil
+	})
+
+	sum := NewInstance("sum", func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+		var doubled int
+
+		if err := in.Assign("source", &doubled); err != nil {
+			return nil, err
+		}
+
+		return doubled + 1, nil
+	}, "source", "flaky")
+
+	broken := NewInstance("broken", func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+		return nil, errors.New("Broken")
+	}, "source")
+
+	afterBroken := NewInstance("afterBroken", func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+		return nil, nil
+	}, "broken")
+
+	omitted := When(NewInstance("omitted", func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+		return nil, errors.New("Should not run")
+	}), func(data interface{}, in Inputs) bool { return false })
+
+	afterOmitted := NewInstance("afterOmitted", func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+		if _, ok := in["omitted"]; ok {
+			return nil, errors.New("Output of omitted instance is passed")
+		}
+
+		return nil, nil
+	}, "omitted")
+
+	agr := newAggregator(t, []AggregatorOption{InstanceRetry("flaky", 3, time.Millisecond)},
+		source, flaky, sum, broken, afterBroken, omitted, afterOmitted)
+
+	report, err := agr.ProcessContext(context.Background(), 20)
+	if err == nil {
+		t.Fatal("Expected error of not processed instances")
+	}
+
+	if out, ok := report.Output("sum"); !ok || out != 41 {
+		t.Fatalf("Expected output 41 of sum, got %v", out)
+	}
+
+	if res := assertStatus(t, report, "flaky", InstanceSucceeded); res.Attempts != 3 {
+		t.Fatalf("Expected 3 attempts of flaky, got %d", res.Attempts)
+	}
+
+	assertStatus(t, report, "broken", InstanceFailed)
+	assertStatus(t, report, "afterBroken", InstanceSkipped)
+	assertStatus(t, report, "omitted", InstanceOmitted)
+	assertStatus(t, report, "afterOmitted", InstanceSucceeded)
+
+	if _, ok := err.(NotProcessedError)["afterBroken"]; !ok {
+		t.Fatalf("Expected skipped instance in error, got %v", err)
+	}
+}
+
+func TestAggregatorTimeout(t *testing.T) {
+	slow := &blockingInstance{name: "slow", timeout: 20 * time.Millisecond, delay: 200 * time.Millisecond}
+	conditional := &blockingInstance{name: "conditional", timeout: 20 * time.Millisecond, delay: 200 * time.Millisecond}
+
+	agr := newAggregator(t, []AggregatorOption{InstanceRetry("slow", 3, time.Millisecond)},
+		slow, When(conditional, func(data interface{}, in Inputs) bool { return true }))
+
+	start := time.Now()
+	report := agr.Process(nil)
+
+	if elapsed := time.Since(start); elapsed >= 150*time.Millisecond {
+		t.Fatalf("Expected instances to be interrupted by timeout, took %s", elapsed)
+	}
+
+	if res := assertStatus(t, report, "slow", InstanceFailed); res.Attempts != 1 {
+		t.Fatalf("Expected abandoned instance not to be retried, got %d attempts", res.Attempts)
+	}
+
+	assertStatus(t, report, "conditional", InstanceFailed)
+
+	time.Sleep(250 * time.Millisecond)
+
+	if calls, maxRun := atomic.LoadInt32(&slow.calls), atomic.LoadInt32(&slow.maxRun); calls != 1 || maxRun != 1 {
+		t.Fatalf("Expected single call of slow instance, got %d calls, %d at once", calls, maxRun)
+	}
+}
+
+func TestAggregatorMaxParallelism(t *testing.T) {
+	shared := &blockingInstance{delay: 20 * time.Millisecond}
+
+	var instances []Instance
+
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		instances = append(instances, NewInstance(name, func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+			return nil, shared.Process(data)
+		}))
+	}
+
+	report, err := newAggregator(t, []AggregatorOption{MaxParallelism(2)}, instances...).ProcessContext(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, inst := range instances {
+		assertStatus(t, report, inst.Name(), InstanceSucceeded)
+	}
+
+	if maxRun := atomic.LoadInt32(&shared.maxRun); maxRun > 2 {
+		t.Fatalf("Expected at most 2 instances at once, got %d", maxRun)
+	}
+}
+
+func TestAggregatorFailFast(t *testing.T) {
+	var childCalls int32
+
+	slowStarted := make(chan struct{})
+
+	//failing waits for slow to start, so slow is running when
+	//processing is cancelled
+	failing := NewInstance("failing", func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+		<-slowStarted
+
+		return nil, errors.New("Broken")
+	})
+
+	//slow finishes a bit later than cancellation, so its children see
+	//cancelled context before result of parent
+	slow := NewInstance("slow", func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+		close(slowStarted)
+
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+
+		return nil, ctx.Err()
+	})
+
+	child := func(name string) DataInstance {
+		return NewInstance(name, func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+			atomic.AddInt32(&childCalls, 1)
+
+			return nil, nil
+		}, "slow")
+	}
+
+	agr := newAggregator(t, []AggregatorOption{InstanceFailurePolicy("failing", FailFast)}, failing, slow, child("first"), child("second"))
+
+	report, err := agr.ProcessContext(context.Background(), nil)
+	if err == nil {
+		t.Fatal("Expected error of cancelled instances")
+	}
+
+	assertStatus(t, report, "failing", InstanceFailed)
+
+	for _, name := range []string{"first", "second"} {
+		res := assertStatus(t, report, name, InstanceCancelled)
+
+		if res.Err == nil || res.Err.Error() != "Instance failing failed: Broken" {
+			t.Fatalf("Expected cancelled instance %s to report failed one, got %v", name, res.Err)
+		}
+
+		if _, ok := err.(NotProcessedError)[name]; !ok {
+			t.Fatalf("Expected cancelled instance %s in error, got %v", name, err)
+		}
+	}
+
+	if calls := atomic.LoadInt32(&childCalls); calls != 0 {
+		t.Fatalf("Expected cancelled instances not to run, got %d calls", calls)
+	}
+}
+
+func TestAggregatorContinueOnFailure(t *testing.T) {
+	broken := NewInstance("broken", func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+		return "partial", errors.New("Broken")
+	})
+
+	child := NewInstance("child", func(ctx context.Context, data interface{}, in Inputs) (interface{}, error) {
+		if _, ok := in["broken"]; ok {
+			return nil, errors.New("Output of failed instance is passed")
+		}
+
+		return nil, nil
+	}, "broken")
+
+	report, err := newAggregator(t, []AggregatorOption{InstanceFailurePolicy("broken", ContinueOnFailure)}, broken, child).
+		ProcessContext(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertStatus(t, report, "broken", InstanceFailed)
+	assertStatus(t, report, "child", InstanceSucceeded)
+}
@@ -0,0 +1,125 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//DeadLetter describes event which was not consumed in all attempts
+type DeadLetter struct {
+	EventName string
+	ID        ID
+	Event     interface{}
+	Err       error
+	Attempts  int
+	FailedAt  time.Time
+}
+
+//DeadLetterSink stores events, which are not going to be consumed anymore
+type DeadLetterSink interface {
+	Store(letter DeadLetter) error
+}
+
+//PermanentError is implemented by errors, after which repeating of
+//consuming is useless. Such events are moved to dead letter sink at once
+type PermanentError interface {
+	error
+	Permanent() bool
+}
+
+func isPermanent(err error) bool {
+	var p PermanentError
+
+	return errors.As(err, &p) && p.Permanent()
+}
+
+//FinalErrorHook is called after event is moved to dead letter sink
+type FinalErrorHook func(letter DeadLetter)
+
+//DeadLetterPolicy counts failed attempts of every event. When count reaches
+//maxAttempts or error is permanent, event is stored in sink and
+//acknowledged in repository
+type DeadLetterPolicy struct {
+	maxAttempts int
+	sink        DeadLetterSink
+	hook        FinalErrorHook
+	attempts    map[string]map[ID]int
+	mu          sync.Mutex
+}
+
+func NewDeadLetterPolicy(maxAttempts int, sink DeadLetterSink, hook FinalErrorHook) *DeadLetterPolicy {
+	return &DeadLetterPolicy{
+		maxAttempts: maxAttempts,
+		sink:        sink,
+		hook:        hook,
+		attempts:    make(map[string]map[ID]int),
+	}
+}
+
+//Attempts returns count of failed attempts of event
+func (p *DeadLetterPolicy) Attempts(eventName string, id ID) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.attempts[eventName][id]
+}
+
+//apply moves events exceeded retry budget to dead letter sink and
+//marks them as consumed. Count of moved events is returned
+func (p *DeadLetterPolicy) apply(conf *TaskConfig) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	attempts, ok := p.attempts[conf.Name]
+	if !ok {
+		attempts = make(map[ID]int)
+		p.attempts[conf.Name] = attempts
+	}
+
+	events := conf.showAllEvents()
+
+	var moved int
+	var lastErr error
+
+	for id, consumeErr := range conf.ShowConsumigResult() {
+		if consumeErr == nil {
+			delete(attempts, id)
+
+			continue
+		}
+
+		attempts[id]++
+
+		if attempts[id] < p.maxAttempts && !isPermanent(consumeErr) {
+			continue
+		}
+
+		letter := DeadLetter{
+			EventName: conf.Name,
+			ID:        id,
+			Event:     events[id],
+			Err:       consumeErr,
+			Attempts:  attempts[id],
+			FailedAt:  time.Now(),
+		}
+
+		if err := p.sink.Store(letter); err != nil {
+			lastErr = fmt.Errorf("Unable to store event %v of %s in dead letter sink: %s", id, conf.Name, err)
+
+			continue
+		}
+
+		conf.SetError(id, nil)
+		delete(attempts, id)
+
+		moved++
+
+		if p.hook != nil {
+			p.hook(letter)
+		}
+	}
+
+	return moved, lastErr
+}
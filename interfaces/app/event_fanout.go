@@ -0,0 +1,176 @@
+package app
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+//MergeStrategy defines how results of several consumers are
+//combined into acknowledgment result of event
+type MergeStrategy uint8
+
+const (
+	//AllMustSucceed acknowledges event consumed by every consumer
+	AllMustSucceed MergeStrategy = iota
+	//AnySuccess acknowledges event consumed by at least one consumer
+	AnySuccess
+	//OnlyResultMatter acknowledges event consumed by every consumer
+	//with IsResultMatter. Results of other consumers are ignored
+	OnlyResultMatter
+)
+
+type fanOutResultsKey struct {
+	name string
+}
+
+//FanOutConsumer passes every batch to all consumers. Each consumer
+//writes results to its own copy of TaskConfig
+type FanOutConsumer struct {
+	cons     []EventConsumerExtension
+	strategy MergeStrategy
+	parallel bool
+}
+
+func NewFanOutConsumer(strategy MergeStrategy, parallel bool, cons ...EventConsumerExtension) *FanOutConsumer {
+	return &FanOutConsumer{
+		cons:     cons,
+		strategy: strategy,
+		parallel: parallel,
+	}
+}
+
+func (f *FanOutConsumer) Name() string {
+	return EventConsumerArr(f.cons).Name()
+}
+
+//FanOutResults returns results of every consumer by its name
+//written to conf by FanOutConsumer
+func FanOutResults(conf *TaskConfig, f *FanOutConsumer) map[string]AcknowledgmentResult {
+	res, _ := conf.GetContext(fanOutResultsKey{f.Name()}).(map[string]AcknowledgmentResult)
+
+	return res
+}
+
+func (f *FanOutConsumer) Consume(conf *TaskConfig) error {
+	results := make([]AcknowledgmentResult, len(f.cons))
+
+	consume := func(i int) {
+		consConf := conf.clone()
+
+		if err := f.consume(i, consConf); err != nil {
+			consConf.SetErrorToAll(err)
+		}
+
+		results[i] = consConf.ShowConsumigResult()
+	}
+
+	if f.parallel {
+		consumersWg := sync.WaitGroup{}
+		consumersWg.Add(len(f.cons))
+
+		for i := range f.cons {
+			go func(ind int) {
+				defer consumersWg.Done()
+
+				consume(ind)
+			}(i)
+		}
+
+		consumersWg.Wait()
+	} else {
+		for i := range f.cons {
+			consume(i)
+		}
+	}
+
+	byName := make(map[string]AcknowledgmentResult, len(f.cons))
+
+	for i := range f.cons {
+		byName[f.cons[i].Name()] = results[i]
+	}
+
+	conf.WriteCtx(fanOutResultsKey{f.Name()}, byName)
+
+	for _, id := range conf.EventIDs() {
+		conf.SetError(id, f.merge(id, results))
+	}
+
+	return nil
+}
+
+func (f *FanOutConsumer) consume(i int, conf *TaskConfig) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("Panic in consumer %s: %s. %s", f.cons[i].Name(), fmt.Sprint(rec), string(debug.Stack()))
+		}
+	}()
+
+	return f.cons[i].Consume(conf)
+}
+
+//FanOutError contains errors of consumers by order of consumers
+type FanOutError struct {
+	Names  []string
+	Errors []error
+}
+
+func (e FanOutError) Error() string {
+	var errText string
+
+	for i := range e.Errors {
+		errText += fmt.Sprintf("%s: %s. ", e.Names[i], e.Errors[i])
+	}
+
+	return errText
+}
+
+//Unwrap returns error of consumer, when only one consumer failed
+func (e FanOutError) Unwrap() error {
+	if len(e.Errors) != 1 {
+		return nil
+	}
+
+	return e.Errors[0]
+}
+
+//Permanent reports whether errors of all consumers are permanent
+func (e FanOutError) Permanent() bool {
+	for _, err := range e.Errors {
+		if !isPermanent(err) {
+			return false
+		}
+	}
+
+	return len(e.Errors) > 0
+}
+
+func (f *FanOutConsumer) merge(id ID, results []AcknowledgmentResult) error {
+	var fanOutErr FanOutError
+	var isCounted, isSucceeded bool
+
+	for i := range f.cons {
+		if f.strategy == OnlyResultMatter && !f.cons[i].IsResultMatter {
+			continue
+		}
+
+		isCounted = true
+
+		if err := results[i][id]; err != nil {
+			fanOutErr.Names = append(fanOutErr.Names, f.cons[i].Name())
+			fanOutErr.Errors = append(fanOutErr.Errors, err)
+		} else {
+			isSucceeded = true
+		}
+	}
+
+	if !isCounted || len(fanOutErr.Errors) == 0 {
+		return nil
+	}
+
+	if f.strategy == AnySuccess && isSucceeded {
+		return nil
+	}
+
+	return fanOutErr
+}
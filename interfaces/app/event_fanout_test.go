@@ -0,0 +1,193 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type permanentError struct{}
+
+func (permanentError) Error() string {
+	return "Rejected"
+}
+
+func (permanentError) Permanent() bool {
+	return true
+}
+
+//fixedConsumer sets predefined errors to events
+type fixedConsumer struct {
+	name string
+	errs map[ID]error
+}
+
+func (c *fixedConsumer) Name() string {
+	return c.name
+}
+
+func (c *fixedConsumer) Consume(conf *TaskConfig) error {
+	for id, err := range c.errs {
+		conf.SetError(id, err)
+	}
+
+	return nil
+}
+
+func newBatch(ids ...ID) *TaskConfig {
+	conf := NewTaskConfig("event")
+
+	for _, id := range ids {
+		conf.WriteEvent(id, id)
+	}
+
+	return conf
+}
+
+func matter(c EventConsumer) EventConsumerExtension {
+	return EventConsumerExtension{EventConsumer: c, IsResultMatter: true}
+}
+
+func TestFanOutKeepsErrorTypes(t *testing.T) {
+	rejecting := &fixedConsumer{name: "rejecting", errs: map[ID]error{1: permanentError{}, 2: permanentError{}}}
+	failing := &fixedConsumer{name: "failing", errs: map[ID]error{2: errors.New("Unavailable")}}
+
+	conf := newBatch(1, 2)
+
+	if err := NewFanOutConsumer(AllMustSucceed, false, matter(rejecting), matter(failing)).Consume(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	res := conf.ShowConsumigResult()
+
+	var p permanentError
+	if !isPermanent(res[1]) || !errors.As(res[1], &p) {
+		t.Fatalf("Expected single error to keep its type, got %#v", res[1])
+	}
+
+	if res[2] == nil || isPermanent(res[2]) {
+		t.Fatalf("Expected error with temporary part not to be permanent, got %#v", res[2])
+	}
+}
+
+func TestFanOutStrategies(t *testing.T) {
+	first := &fixedConsumer{name: "first", errs: map[ID]error{1: errors.New("First failed"), 3: errors.New("First failed")}}
+	second := &fixedConsumer{name: "second", errs: map[ID]error{2: errors.New("Second failed"), 3: errors.New("Second failed")}}
+
+	cases := []struct {
+		strategy MergeStrategy
+		failed   map[ID]bool
+	}{
+		{AllMustSucceed, map[ID]bool{1: true, 2: true, 3: true, 4: false}},
+		{AnySuccess, map[ID]bool{1: false, 2: false, 3: true, 4: false}},
+		{OnlyResultMatter, map[ID]bool{1: true, 2: false, 3: true, 4: false}},
+	}
+
+	for _, c := range cases {
+		conf := newBatch(1, 2, 3, 4)
+
+		f := NewFanOutConsumer(c.strategy, false, matter(first), EventConsumerExtension{EventConsumer: second})
+		if err := f.Consume(conf); err != nil {
+			t.Fatal(err)
+		}
+
+		for id, err := range conf.ShowConsumigResult() {
+			if (err != nil) != c.failed[id] {
+				t.Fatalf("Strategy %d: expected failed %v of event %v, got %v", c.strategy, c.failed[id], id, err)
+			}
+		}
+
+		results := FanOutResults(conf, f)
+		if results["first"][1] == nil || results["second"][2] == nil || results["second"][1] != nil {
+			t.Fatalf("Strategy %d: expected results of every consumer, got %v", c.strategy, results)
+		}
+	}
+}
+
+func TestEventConsumerArrIgnoresNotMatteringResult(t *testing.T) {
+	matters := &fixedConsumer{name: "matters", errs: map[ID]error{1: errors.New("Failed")}}
+	ignored := &fixedConsumer{name: "ignored", errs: map[ID]error{2: errors.New("Failed")}}
+
+	conf := newBatch(1, 2)
+
+	if err := (EventConsumerArr{matter(matters), {EventConsumer: ignored}}).Consume(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	res := conf.ShowConsumigResult()
+
+	if res[1] == nil {
+		t.Fatal("Expected error of consumer with result matter")
+	}
+
+	if res[2] != nil {
+		t.Fatalf("Expected error of consumer without result matter to be ignored, got %v", res[2])
+	}
+}
+
+//barrierConsumer waits until all consumers sharing the barrier start
+type barrierConsumer struct {
+	name    string
+	started *sync.WaitGroup
+}
+
+func (c *barrierConsumer) Name() string {
+	return c.name
+}
+
+func (c *barrierConsumer) Consume(conf *TaskConfig) error {
+	c.started.Done()
+
+	done := make(chan struct{})
+
+	go func() {
+		c.started.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(time.Second):
+		return errors.New("Consumers are not run in parallel")
+	}
+}
+
+type panicConsumer struct{}
+
+func (panicConsumer) Name() string {
+	return "panic"
+}
+
+func (panicConsumer) Consume(conf *TaskConfig) error {
+	panic("Broken")
+}
+
+func TestFanOutParallel(t *testing.T) {
+	started := &sync.WaitGroup{}
+	started.Add(2)
+
+	conf := newBatch(1, 2)
+
+	f := NewFanOutConsumer(OnlyResultMatter, true,
+		matter(&barrierConsumer{name: "first", started: started}),
+		matter(&barrierConsumer{name: "second", started: started}),
+		EventConsumerExtension{EventConsumer: panicConsumer{}})
+
+	if err := f.Consume(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, err := range conf.ShowConsumigResult() {
+		if err != nil {
+			t.Fatalf("Expected event %v to be consumed, got %v", id, err)
+		}
+	}
+
+	for id, err := range FanOutResults(conf, f)["panic"] {
+		if err == nil {
+			t.Fatalf("Expected panic to be set as error of event %v", id)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package app
+
+//IdempotencyStore remembers events, which were consumed by consumer
+type IdempotencyStore interface {
+	//Processed returns ids, which were already remembered
+	Processed(eventName, consumerName string, ids []ID) (map[ID]bool, error)
+	Remember(eventName, consumerName string, ids []ID) error
+}
+
+//WithIdempotency makes processor skip events, which are found in store.
+//Such events are acknowledged without consuming
+func (evp *EventProcessor) WithIdempotency(store IdempotencyStore) *EventProcessor {
+	evp.store = store
+
+	return evp
+}
+
+//excludeProcessed removes events found in store from the batch
+func (evp *EventProcessor) excludeProcessed(conf *TaskConfig) error {
+	processed, err := evp.store.Processed(conf.Name, evp.eCons.Name(), conf.EventIDs())
+	if err != nil {
+		return err
+	}
+
+	for id, isProcessed := range processed {
+		if isProcessed {
+			conf.ExcludeEvent(id)
+		}
+	}
+
+	return nil
+}
+
+func (evp *EventProcessor) rememberConsumed(conf *TaskConfig) error {
+	events := conf.ShowEvents()
+
+	var consumed []ID
+
+	for id, err := range conf.ShowConsumigResult() {
+		if _, isInBatch := events[id]; isInBatch && err == nil {
+			consumed = append(consumed, id)
+		}
+	}
+
+	if len(consumed) == 0 {
+		return nil
+	}
+
+	return evp.store.Remember(conf.Name, evp.eCons.Name(), consumed)
+}
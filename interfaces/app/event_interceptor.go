@@ -0,0 +1,59 @@
+package app
+
+//Stage is a step of event processing
+type Stage string
+
+const (
+	StageGetNew     Stage = "getNew"
+	StageAdapt      Stage = "adapt"
+	StageConsume    Stage = "consume"
+	StageConfirmAck Stage = "confirmAck"
+)
+
+//StageFunc executes stage of event processing
+type StageFunc func(conf *TaskConfig) error
+
+//Interceptor wraps every stage of EventProcessor. Stage could be
+//used to decide whether interceptor should do anything
+type Interceptor func(stage Stage, next StageFunc) StageFunc
+
+//InterceptorChain wraps stages by interceptors. The first added
+//interceptor is the outermost one
+type InterceptorChain struct {
+	interceptors []Interceptor
+}
+
+func NewInterceptorChain() *InterceptorChain {
+	return &InterceptorChain{}
+}
+
+func (c *InterceptorChain) Next(i Interceptor) *InterceptorChain {
+	c.interceptors = append(c.interceptors, i)
+
+	return c
+}
+
+func (c *InterceptorChain) wrap(stage Stage, f StageFunc) StageFunc {
+	if c == nil {
+		return f
+	}
+
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		f = c.interceptors[i](stage, f)
+	}
+
+	return f
+}
+
+//OnStage applies interceptor only to specified stages
+func OnStage(i Interceptor, stages ...Stage) Interceptor {
+	return func(stage Stage, next StageFunc) StageFunc {
+		for _, s := range stages {
+			if s == stage {
+				return i(stage, next)
+			}
+		}
+
+		return next
+	}
+}
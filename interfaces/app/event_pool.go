@@ -0,0 +1,98 @@
+package app
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+//SingleEventConsumer handles events one by one
+type SingleEventConsumer interface {
+	ConsumeEvent(taskConfig *TaskConfig, id ID, event interface{}) error
+	Name() string
+}
+
+type poolConsumer struct {
+	cons    SingleEventConsumer
+	workers int
+}
+
+//NewPoolConsumer creates EventConsumer, which passes events of the batch
+//to cons using workers goroutines. Error of every event is written
+//as its acknowledgment result
+func NewPoolConsumer(cons SingleEventConsumer, workers int) EventConsumer {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &poolConsumer{
+		cons:    cons,
+		workers: workers,
+	}
+}
+
+func (p *poolConsumer) Name() string {
+	return p.cons.Name()
+}
+
+type eventResult struct {
+	id  ID
+	err error
+}
+
+func (p *poolConsumer) Consume(taskConfig *TaskConfig) error {
+	events := make(Events, taskConfig.Len())
+
+	for id, event := range taskConfig.ShowEvents() {
+		events[id] = event
+	}
+
+	jobs := make(chan ID)
+	results := make(chan eventResult, len(events))
+
+	workers := p.workers
+	if workers > len(events) {
+		workers = len(events)
+	}
+
+	workerWg := sync.WaitGroup{}
+	workerWg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer workerWg.Done()
+
+			for id := range jobs {
+				results <- eventResult{
+					id:  id,
+					err: p.consumeEvent(taskConfig, id, events[id]),
+				}
+			}
+		}()
+	}
+
+	for id := range events {
+		jobs <- id
+	}
+
+	close(jobs)
+
+	workerWg.Wait()
+	close(results)
+
+	for res := range results {
+		taskConfig.SetError(res.id, res.err)
+	}
+
+	return nil
+}
+
+func (p *poolConsumer) consumeEvent(taskConfig *TaskConfig, id ID, event interface{}) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("Panic while consuming event %v by %s: %s. %s", id, p.cons.Name(), fmt.Sprint(rec), string(debug.Stack()))
+		}
+	}()
+
+	return p.cons.ConsumeEvent(taskConfig, id, event)
+}
@@ -1,26 +1,47 @@
 package app
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
 	"runtime/debug"
+	"sync"
 )
 
+//TaskConfig contains batch of events and results of their consuming.
+//It is safe for concurrent use
 type TaskConfig struct {
-	Name    string
-	context map[interface{}]interface{}
-	events Events
-	ackResult  AcknowledgmentResult
+	Name      string
+	context   map[interface{}]interface{}
+	events    Events
+	ackResult AcknowledgmentResult
+	excluded  Events
+	order     []ID
+	limit     int
+	mu        sync.RWMutex
+}
+
+func NewTaskConfig(name string) *TaskConfig {
+	return &TaskConfig{
+		Name:      name,
+		context:   make(map[interface{}]interface{}),
+		events:    make(Events),
+		ackResult: make(AcknowledgmentResult),
+	}
 }
 
 
 type EventProcessor struct {
-	f         EventAdapter
-	eRero     EventRepository
-	eCons     EventConsumer
-	eventName string
-	log       Logger
+	f            EventAdapter
+	eRero        EventRepository
+	eCons        EventConsumer
+	eventName    string
+	log          Logger
+	dlp          *DeadLetterPolicy
+	interceptors *InterceptorChain
+	store        IdempotencyStore
+	batchSize    int
 }
 
 type ID interface{}
@@ -38,6 +59,12 @@ type EventRepository interface {
 	ConfirmAck(task *TaskConfig, consumerName string) error
 }
 
+//NotifyingEventRepository signals when new events of eventName appear
+type NotifyingEventRepository interface {
+	EventRepository
+	NewEvents(eventName string) (<-chan struct{}, error)
+}
+
 type EventConsumer interface {
 	Consume(taskConfig *TaskConfig) error
 	Name() string
@@ -53,6 +80,28 @@ func NewEventProcessor(eRepo EventRepository, eCons EventConsumer, name string,
 	}
 }
 
+//WithDeadLetter sets policy for events which are failed to consume
+func (evp *EventProcessor) WithDeadLetter(p *DeadLetterPolicy) *EventProcessor {
+	evp.dlp = p
+
+	return evp
+}
+
+//WithBatchSize limits count of events received at once.
+//Repository may ignore the limit
+func (evp *EventProcessor) WithBatchSize(n int) *EventProcessor {
+	evp.batchSize = n
+
+	return evp
+}
+
+//WithInterceptors wraps every stage of processing by chain
+func (evp *EventProcessor) WithInterceptors(chain *InterceptorChain) *EventProcessor {
+	evp.interceptors = chain
+
+	return evp
+}
+
 func (evp *EventProcessor) error(err error) error {
 	if evp.log != nil {
 		evp.log.Error(err)
@@ -62,11 +111,28 @@ func (evp *EventProcessor) error(err error) error {
 }
 
 func (tConf *TaskConfig) AllocateMemForEvents(cap int) {
+	tConf.mu.Lock()
+	defer tConf.mu.Unlock()
+
 	tConf.events = make(Events, cap)
 	tConf.ackResult = make(AcknowledgmentResult, cap)
+	tConf.excluded = nil
+	tConf.order = make([]ID, 0, cap)
 }
 
 func (tConf *TaskConfig) WriteEvent(id ID, data interface{}) {
+	tConf.mu.Lock()
+	defer tConf.mu.Unlock()
+
+	if tConf.events == nil {
+		tConf.events = make(Events)
+		tConf.ackResult = make(AcknowledgmentResult)
+	}
+
+	if _, ok := tConf.events[id]; !ok {
+		tConf.order = append(tConf.order, id)
+	}
+
 	tConf.events[id] = data
 	tConf.ackResult[id] = nil
 }
@@ -149,52 +215,299 @@ func (tConf *TaskConfig) WriteEventsFromSliceOfPtrToStruct(sliceOfPtrToStruct in
 }
 
 func (tConf *TaskConfig) WriteCtx(key, value interface{}) {
+	tConf.mu.Lock()
+	defer tConf.mu.Unlock()
+
+	if tConf.context == nil {
+		tConf.context = make(map[interface{}]interface{})
+	}
+
 	tConf.context[key] = value
 }
 
 func (tConf *TaskConfig) SetError(id ID, err error) {
+	tConf.mu.Lock()
+	defer tConf.mu.Unlock()
+
+	if tConf.ackResult == nil {
+		tConf.ackResult = make(AcknowledgmentResult)
+	}
+
 	tConf.ackResult[id] = err
 }
 
 func (tConf *TaskConfig) SetErrorOK(id ID, err error) bool {
+	tConf.mu.Lock()
+	defer tConf.mu.Unlock()
+
 	_, ok := tConf.ackResult[id]
 	if !ok {
 		return false
 	}
 
-	tConf.SetError(id, err)
+	tConf.ackResult[id] = err
 
 	return true
 }
 
 func (tConf *TaskConfig) Len() int {
+	tConf.mu.RLock()
+	defer tConf.mu.RUnlock()
+
 	return len(tConf.events)
 }
 
+//ShowEvents returns copy of events
 func (tConf *TaskConfig) ShowEvents() Events {
-	return tConf.events
+	tConf.mu.RLock()
+	defer tConf.mu.RUnlock()
+
+	events := make(Events, len(tConf.events))
+
+	for id, event := range tConf.events {
+		events[id] = event
+	}
+
+	return events
 }
 
+//ShowConsumigResult returns copy of acknowledgment results
 func (tConf *TaskConfig) ShowConsumigResult() AcknowledgmentResult {
-	return tConf.ackResult
+	tConf.mu.RLock()
+	defer tConf.mu.RUnlock()
+
+	ackResult := make(AcknowledgmentResult, len(tConf.ackResult))
+
+	for id, err := range tConf.ackResult {
+		ackResult[id] = err
+	}
+
+	return ackResult
 }
 
 func (tConf *TaskConfig) SetErrorToAll(err error) {
+	tConf.mu.Lock()
+	defer tConf.mu.Unlock()
+
 	for id := range tConf.ackResult {
 		tConf.ackResult[id] = err
 	}
 }
 
 func (tConf *TaskConfig) GetContext(id interface{}) interface{} {
+	tConf.mu.RLock()
+	defer tConf.mu.RUnlock()
+
 	return tConf.context[id]
 }
 
 func (tConf *TaskConfig) GetContextOK(id interface{}) (interface{}, bool) {
+	tConf.mu.RLock()
+	defer tConf.mu.RUnlock()
+
 	val, ok := tConf.context[id]
 
 	return val, ok
 }
 
+//EventIDs returns identifiers of all events in batch in the order
+//they were written. Events added to Events map directly follow them
+func (tConf *TaskConfig) EventIDs() []ID {
+	tConf.mu.RLock()
+	defer tConf.mu.RUnlock()
+
+	ids := make([]ID, 0, len(tConf.events))
+	seen := make(map[ID]bool, len(tConf.events))
+
+	for _, id := range tConf.order {
+		if _, ok := tConf.events[id]; !ok || seen[id] {
+			continue
+		}
+
+		seen[id] = true
+		ids = append(ids, id)
+	}
+
+	for id := range tConf.events {
+		if !seen[id] {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+//GetEventAs decodes event into the value pointed by dst. Events
+//represented by []byte are decoded as json
+func (tConf *TaskConfig) GetEventAs(id ID, dst interface{}) error {
+	tConf.mu.RLock()
+	event, ok := tConf.events[id]
+	tConf.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("Not found event %v in %s", id, tConf.Name)
+	}
+
+	if err := decodeTo(event, dst); err != nil {
+		return fmt.Errorf("Unable to decode event %v of %s: %s", id, tConf.Name, err)
+	}
+
+	return nil
+}
+
+//GetContextAs copies context value into the value pointed by dst
+func (tConf *TaskConfig) GetContextAs(key interface{}, dst interface{}) error {
+	val, ok := tConf.GetContextOK(key)
+	if !ok {
+		return fmt.Errorf("Not found context value %v in %s", key, tConf.Name)
+	}
+
+	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() != reflect.Ptr || dstVal.IsNil() {
+		return errors.New("Destination is not a pointer")
+	}
+
+	if val == nil || !reflect.TypeOf(val).AssignableTo(dstVal.Elem().Type()) {
+		return fmt.Errorf("Context value %v has type %T, which is not assignable to %s", key, val, dstVal.Elem().Type())
+	}
+
+	dstVal.Elem().Set(reflect.ValueOf(val))
+
+	return nil
+}
+
+func decodeTo(src interface{}, dst interface{}) error {
+	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() != reflect.Ptr || dstVal.IsNil() {
+		return errors.New("Destination is not a pointer")
+	}
+
+	if src == nil {
+		return errors.New("Source is nil")
+	}
+
+	dstType := dstVal.Elem().Type()
+	srcVal := reflect.ValueOf(src)
+
+	if srcVal.Type().AssignableTo(dstType) {
+		dstVal.Elem().Set(srcVal)
+
+		return nil
+	}
+
+	if srcVal.Kind() == reflect.Ptr && !srcVal.IsNil() && srcVal.Elem().Type().AssignableTo(dstType) {
+		dstVal.Elem().Set(srcVal.Elem())
+
+		return nil
+	}
+
+	if b, ok := src.([]byte); ok {
+		if err := json.Unmarshal(b, dst); err != nil {
+			return fmt.Errorf("Payload is not a valid json of %s: %s", dstType, err)
+		}
+
+		return nil
+	}
+
+	b, err := json.Marshal(src)
+	if err != nil {
+		return fmt.Errorf("Unable to convert %T to %s: %s", src, dstType, err)
+	}
+
+	if err := json.Unmarshal(b, dst); err != nil {
+		return fmt.Errorf("Unable to convert %T to %s: %s", src, dstType, err)
+	}
+
+	return nil
+}
+
+//SetLimit sets max count of events, which repository should write
+//to the batch. Zero means no limit
+func (tConf *TaskConfig) SetLimit(n int) {
+	tConf.mu.Lock()
+	defer tConf.mu.Unlock()
+
+	tConf.limit = n
+}
+
+func (tConf *TaskConfig) Limit() int {
+	tConf.mu.RLock()
+	defer tConf.mu.RUnlock()
+
+	return tConf.limit
+}
+
+//ExcludeEvent removes event from the batch. Its acknowledgment
+//result is kept, so repository still confirms it
+func (tConf *TaskConfig) ExcludeEvent(id ID) {
+	tConf.mu.Lock()
+	defer tConf.mu.Unlock()
+
+	event, ok := tConf.events[id]
+	if !ok {
+		return
+	}
+
+	if tConf.excluded == nil {
+		tConf.excluded = make(Events)
+	}
+
+	tConf.excluded[id] = event
+
+	delete(tConf.events, id)
+}
+
+//showAllEvents returns copy of events including excluded ones
+func (tConf *TaskConfig) showAllEvents() Events {
+	tConf.mu.RLock()
+	defer tConf.mu.RUnlock()
+
+	events := make(Events, len(tConf.events)+len(tConf.excluded))
+
+	for id, event := range tConf.excluded {
+		events[id] = event
+	}
+
+	for id, event := range tConf.events {
+		events[id] = event
+	}
+
+	return events
+}
+
+//clone copies events and results, so they can be changed
+//independently from original
+func (tConf *TaskConfig) clone() *TaskConfig {
+	tConf.mu.RLock()
+	defer tConf.mu.RUnlock()
+
+	c := NewTaskConfig(tConf.Name)
+
+	for key, val := range tConf.context {
+		c.context[key] = val
+	}
+
+	for id, event := range tConf.events {
+		c.events[id] = event
+	}
+
+	for id, err := range tConf.ackResult {
+		c.ackResult[id] = err
+	}
+
+	for id, event := range tConf.excluded {
+		if c.excluded == nil {
+			c.excluded = make(Events)
+		}
+
+		c.excluded[id] = event
+	}
+
+	c.order = append(c.order, tConf.order...)
+
+	return c
+}
+
 func (evp *EventProcessor) logNotProcessedEvents(config *TaskConfig) {
 	if evp.log == nil {
 		return
@@ -232,48 +545,123 @@ func (evp *EventProcessor) logNotProcessedEvents(config *TaskConfig) {
 }
 
 func (evp *EventProcessor) Process(needLogNotProcessedEvents bool) error {
+	_, err := evp.ProcessBatch(needLogNotProcessedEvents)
+
+	return err
+}
+
+//ProcessBatch works as Process and returns count of received events
+func (evp *EventProcessor) ProcessBatch(needLogNotProcessedEvents bool) (int, error) {
+	stats, err := evp.ProcessBatchStats(needLogNotProcessedEvents)
+
+	return stats.Received, err
+}
+
+//BatchStats describes processed batch. Confirmed counts events, which
+//were consumed, skipped as processed or moved to dead letter sink
+type BatchStats struct {
+	Received  int
+	Confirmed int
+}
+
+//ProcessBatchStats works as Process and describes processed batch
+func (evp *EventProcessor) ProcessBatchStats(needLogNotProcessedEvents bool) (stats BatchStats, resErr error) {
 	defer func() {
 		if rec := recover(); rec != nil {
 			err := fmt.Sprint(rec)
 
-			evp.log.Error(fmt.Errorf("Panic while executing %s: %s. %s", evp.eventName, err, string(debug.Stack())))
+			resErr = fmt.Errorf("Panic while executing %s: %s. %s", evp.eventName, err, string(debug.Stack()))
+
+			evp.log.Error(resErr)
 		}
 	}()
 
-	conf := &TaskConfig{
-		Name:    evp.eventName,
-		context: make(map[interface{}]interface{}),
+	conf := NewTaskConfig(evp.eventName)
+	conf.SetLimit(evp.batchSize)
+
+	if err := evp.interceptors.wrap(StageGetNew, evp.getNew)(conf); err != nil {
+		return stats, evp.error(err)
 	}
 
-	if err := evp.eRero.GetNew(conf, evp.eCons.Name()); err != nil {
-		return evp.error(err)
+	//Events excluded by repository, e.g. failed to decode, are counted too,
+	//so their errors reach dead letter policy and acknowledgment
+	stats.Received = len(conf.ShowConsumigResult())
+
+	if stats.Received == 0 {
+		return stats, nil
 	}
 
-	if len(conf.events) == 0 {
-		return nil
+	if evp.store != nil {
+		if err := evp.excludeProcessed(conf); err != nil {
+			return stats, evp.error(err)
+		}
 	}
 
-	if evp.f == nil {
-		return evp.error(errors.New("No adapter provided"))
+	if conf.Len() > 0 {
+		if err := evp.consume(conf); err != nil {
+			return stats, evp.error(err)
+		}
 	}
 
-	if err := evp.f(conf.events); err != nil {
-		return evp.error(err)
+	if evp.dlp != nil {
+		moved, err := evp.dlp.apply(conf)
+		if err != nil {
+			evp.error(err)
+		}
+
+		if moved > 0 && evp.log != nil {
+			evp.log.Info(fmt.Sprintf("%d events of %s moved to dead letter sink", moved, evp.eventName))
+		}
 	}
 
-	if err := evp.eCons.Consume(conf); err != nil {
-		return evp.error(err)
+	if evp.store != nil {
+		if err := evp.rememberConsumed(conf); err != nil {
+			evp.error(err)
+		}
 	}
 
 	if needLogNotProcessedEvents {
 		evp.logNotProcessedEvents(conf)
 	}
 
-	if err := evp.eRero.ConfirmAck(conf, evp.eCons.Name()); err != nil {
-		return evp.error(err)
+	if err := evp.interceptors.wrap(StageConfirmAck, evp.confirmAck)(conf); err != nil {
+		return stats, evp.error(err)
 	}
 
-	return nil
+	for _, err := range conf.ShowConsumigResult() {
+		if err == nil {
+			stats.Confirmed++
+		}
+	}
+
+	return stats, nil
+}
+
+func (evp *EventProcessor) consume(conf *TaskConfig) error {
+	if err := evp.interceptors.wrap(StageAdapt, evp.adapt)(conf); err != nil {
+		return err
+	}
+
+	return evp.interceptors.wrap(StageConsume, evp.eCons.Consume)(conf)
+}
+
+func (evp *EventProcessor) getNew(conf *TaskConfig) error {
+	return evp.eRero.GetNew(conf, evp.eCons.Name())
+}
+
+func (evp *EventProcessor) adapt(conf *TaskConfig) error {
+	if evp.f == nil {
+		return errors.New("No adapter provided")
+	}
+
+	conf.mu.Lock()
+	defer conf.mu.Unlock()
+
+	return evp.f(conf.events)
+}
+
+func (evp *EventProcessor) confirmAck(conf *TaskConfig) error {
+	return evp.eRero.ConfirmAck(conf, evp.eCons.Name())
 }
 
 func WrapperFunc(f func(msg interface{}) (interface{}, bool, error)) EventAdapter {
@@ -302,27 +690,10 @@ type EventConsumerExtension struct {
 
 type EventConsumerArr []EventConsumerExtension
 
+//Consume passes events to every consumer. Only results of consumers
+//with IsResultMatter affect acknowledgment of events
 func (cons EventConsumerArr) Consume(conf *TaskConfig) error {
-	copyConfig := *conf
-
-	for i := range cons {
-		var consConf *TaskConfig
-
-		if cons[i].IsResultMatter {
-			consConf = conf
-		} else {
-			consConf = new(TaskConfig)
-			*consConf = copyConfig
-		}
-
-		if err := cons[i].Consume(conf); err != nil {
-			if cons[i].IsResultMatter {
-				return err
-			}
-		}
-	}
-
-	return nil
+	return NewFanOutConsumer(OnlyResultMatter, false, cons...).Consume(conf)
 }
 
 func (cons EventConsumerArr) Name() string {
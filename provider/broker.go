@@ -0,0 +1,43 @@
+package provider
+
+import (
+	"errors"
+)
+
+//Message is received from broker and kept until it is acknowledged
+type Message struct {
+	Subject     string
+	Sequence    uint64
+	Data        []byte
+	Redelivered bool
+	ack         func() error
+}
+
+//Ack confirms message in the broker
+func (m *Message) Ack() error {
+	if m == nil || m.ack == nil {
+		return errors.New("Message can't be acknowledged")
+	}
+
+	return m.ack()
+}
+
+//AckHandler is called when published message is acknowledged by server
+//or publishing fails
+type AckHandler func(guid string, err error)
+
+//Broker is implemented by NATS Streaming, JetStream and in-memory
+//providers, so repositories and consumers work with any of them
+type Broker interface {
+	Url() string
+	//Subscribe starts reading subject
+	Subscribe(subject string) error
+	IsQueueActive(subject string) (bool, error)
+	//GetMessages returns up to limit the oldest not acknowledged messages
+	//in sequence order. Zero limit means all messages
+	GetMessages(subject string, limit int) ([]*Message, error)
+	Ack(msgs map[uint64]*Message, subject string)
+	Notify(subject string) <-chan struct{}
+	Publish(subject string, msg []byte) error
+	PublishAsync(subject string, msg []byte, ah AckHandler) (string, error)
+}
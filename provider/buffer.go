@@ -0,0 +1,190 @@
+package provider
+
+import (
+	"sort"
+	"sync"
+)
+
+const DefaultBufferSize = 1024
+
+//BufferStats describes buffer of received and not acknowledged messages
+type BufferStats struct {
+	Depth      int
+	Size       int
+	Received   uint64
+	Acked      uint64
+	Duplicates uint64
+	//Blocked counts deliveries waited for free place
+	Blocked uint64
+}
+
+//messageBuffer keeps messages ordered by sequence. When it is full,
+//put waits until messages are acknowledged
+type messageBuffer struct {
+	size      int
+	msgs      map[uint64]*Message
+	order     []uint64
+	processed map[uint64]bool
+	stats     BufferStats
+	closed    bool
+	mu        sync.Mutex
+	hasSpace  *sync.Cond
+}
+
+func newMessageBuffer(size int) *messageBuffer {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+
+	b := &messageBuffer{
+		size:      size,
+		msgs:      make(map[uint64]*Message),
+		processed: make(map[uint64]bool),
+	}
+
+	b.hasSpace = sync.NewCond(&b.mu)
+
+	return b
+}
+
+//put stores message. Redelivered message replaces kept one, message
+//acknowledged by the last ack is skipped. False is returned if buffer
+//is closed or message is skipped
+func (b *messageBuffer) put(msg *Message) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.processed[msg.Sequence] {
+		b.stats.Duplicates++
+
+		return false
+	}
+
+	if _, ok := b.msgs[msg.Sequence]; ok {
+		b.stats.Duplicates++
+		b.msgs[msg.Sequence] = msg
+
+		return true
+	}
+
+	if len(b.msgs) >= b.size && !b.closed {
+		b.stats.Blocked++
+	}
+
+	for len(b.msgs) >= b.size && !b.closed {
+		b.hasSpace.Wait()
+	}
+
+	if b.closed {
+		return false
+	}
+
+	b.msgs[msg.Sequence] = msg
+	b.stats.Received++
+
+	i := sort.Search(len(b.order), func(i int) bool { return b.order[i] >= msg.Sequence })
+
+	b.order = append(b.order, 0)
+	copy(b.order[i+1:], b.order[i:])
+	b.order[i] = msg.Sequence
+
+	return true
+}
+
+//get returns up to limit the oldest messages. Zero limit means all
+func (b *messageBuffer) get(limit int) []*Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if limit <= 0 || limit > len(b.order) {
+		limit = len(b.order)
+	}
+
+	msgs := make([]*Message, 0, limit)
+
+	for _, sequence := range b.order[:limit] {
+		msgs = append(msgs, b.msgs[sequence])
+	}
+
+	return msgs
+}
+
+//remove deletes acknowledged messages and wakes waiting deliveries
+func (b *messageBuffer) remove(sequences []uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.processed = make(map[uint64]bool, len(sequences))
+
+	for _, sequence := range sequences {
+		b.processed[sequence] = true
+
+		if _, ok := b.msgs[sequence]; !ok {
+			continue
+		}
+
+		delete(b.msgs, sequence)
+		b.stats.Acked++
+	}
+
+	order := b.order[:0]
+
+	for _, sequence := range b.order {
+		if _, ok := b.msgs[sequence]; ok {
+			order = append(order, sequence)
+		}
+	}
+
+	b.order = order
+
+	b.hasSpace.Broadcast()
+}
+
+//waitFree waits until buffer has free place and returns its count.
+//Zero is returned when buffer is closed
+func (b *messageBuffer) waitFree() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.msgs) >= b.size && !b.closed {
+		b.hasSpace.Wait()
+	}
+
+	if b.closed {
+		return 0
+	}
+
+	return b.size - len(b.msgs)
+}
+
+//bufferStats returns state of buffers by subject
+func bufferStats(buffers map[string]*messageBuffer) map[string]BufferStats {
+	stats := make(map[string]BufferStats, len(buffers))
+
+	for subject, buf := range buffers {
+		stats[subject] = buf.statistics()
+	}
+
+	return stats
+}
+
+func (b *messageBuffer) statistics() BufferStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := b.stats
+	stats.Depth = len(b.msgs)
+	stats.Size = b.size
+
+	return stats
+}
+
+//close wakes all waiting deliveries
+func (b *messageBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+
+	b.hasSpace.Broadcast()
+}
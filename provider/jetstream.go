@@ -0,0 +1,446 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DmitriBeattie/custom-framework/config"
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+	nats "github.com/nats-io/nats.go"
+)
+
+const (
+	DefaultFetchSize    = 100
+	DefaultFetchWait    = 5 * time.Second
+	DefaultPublishWait  = 30 * time.Second
+	fetchFailureBackoff = time.Second
+)
+
+//PullConsumer describes durable pull consumer of subject
+type PullConsumer struct {
+	Durable string
+	//FetchSize is size of buffer of not acknowledged messages.
+	//Next messages are fetched when buffer has free place
+	FetchSize int
+	Options   []nats.SubOpt
+}
+
+//PullConsumers maps queue settings to durable pull consumers
+func PullConsumers(queue map[string]config.QueueData) map[string]PullConsumer {
+	result := make(map[string]PullConsumer, len(queue))
+
+	for subject, settings := range queue {
+		result[subject] = NewPullConsumer(settings)
+	}
+
+	return result
+}
+
+//NewPullConsumer maps queue settings to durable pull consumer with
+//explicit ack. MaxInFlight limits not acknowledged messages, BufferSize
+//overrides count of fetched messages. Without start position only new
+//messages are delivered, as NATS Streaming does
+func NewPullConsumer(settings config.QueueData) PullConsumer {
+	c := PullConsumer{
+		Durable: settings.DurableName,
+		Options: []nats.SubOpt{nats.AckExplicit()},
+	}
+
+	//Replicas share messages by pull consumer with the same durable name
+	if c.Durable == "" {
+		c.Durable = settings.QueueGroup
+	}
+
+	if settings.MaxInFligth != nil {
+		c.FetchSize = int(*settings.MaxInFligth)
+		c.Options = append(c.Options, nats.MaxAckPending(int(*settings.MaxInFligth)))
+	}
+
+	if settings.BufferSize != nil {
+		c.FetchSize = *settings.BufferSize
+	}
+
+	start := nats.DeliverNew()
+
+	if settings.StartAtSequence != nil {
+		start = nats.StartSequence(*settings.StartAtSequence)
+	} else if settings.StartAtTime != nil {
+		if time, err := time.Parse("2006-01-02T15:04:05", *settings.StartAtTime); err == nil {
+			start = nats.StartTime(time)
+		}
+	}
+
+	c.Options = append(c.Options, start)
+
+	if settings.AckWaitSeconds != nil {
+		c.Options = append(c.Options, nats.AckWait(time.Second*time.Duration(*settings.AckWaitSeconds)))
+	}
+
+	return c
+}
+
+//JetStream reads subjects by durable pull consumers and keeps fetched
+//messages until they are acknowledged, like NATS does for NATS Streaming
+type JetStream struct {
+	url       string
+	client    string
+	consumers map[string]PullConsumer
+	conn      *nats.Conn
+	js        nats.JetStreamContext
+	log       app.Logger
+	buffers   map[string]*messageBuffer
+	subError  map[string]error
+	sync.RWMutex
+	ConnectionState
+	disconnectSign chan bool
+	stop           chan struct{}
+	fetchers       sync.WaitGroup
+	notifier
+}
+
+func CreateJetStreamConnection(_url string, _client string, _consumers map[string]PullConsumer, _log app.Logger) *JetStream {
+	return &JetStream{
+		url:            _url,
+		client:         _client,
+		consumers:      _consumers,
+		log:            _log,
+		buffers:        make(map[string]*messageBuffer),
+		subError:       make(map[string]error),
+		disconnectSign: make(chan bool),
+	}
+}
+
+func (j *JetStream) Url() string {
+	return j.url
+}
+
+func (j *JetStream) GetState() ConnectionState {
+	j.RLock()
+	defer j.RUnlock()
+
+	return j.ConnectionState
+}
+
+//Open connects to server, creates pull consumers and fetches messages
+//until CloseWithTimeout is called. Reconnection is made by nats client
+func (j *JetStream) Open() {
+	j.Lock()
+
+	if j.ConnectionState != Disconnected && j.ConnectionState != ConnectionFailed && j.ConnectionState != IsNotActive {
+		j.log.Error(fmt.Errorf("Unable to open connection. State: %d", j.ConnectionState))
+
+		j.Unlock()
+
+		return
+	}
+
+	var err error
+
+	j.conn, err = nats.Connect(j.url, nats.Name(j.client), nats.MaxReconnects(-1))
+	if err == nil {
+		j.js, err = j.conn.JetStream()
+	}
+
+	if err != nil {
+		if j.conn != nil {
+			j.conn.Close()
+		}
+
+		j.log.Error(fmt.Errorf("Can't connect to JetStream at %s: %s", j.url, err))
+
+		j.ConnectionState = ConnectionFailed
+
+		j.Unlock()
+
+		return
+	}
+
+	j.stop = make(chan struct{})
+
+	var subscribed int
+
+	for subject, c := range j.consumers {
+		if j.subscribe(subject, c) == nil {
+			subscribed++
+		}
+	}
+
+	if subscribed == 0 {
+		j.log.Error("Nothing to read from JetStream " + j.url)
+
+		j.ConnectionState = NothingToRead
+	} else {
+		j.ConnectionState = Reading
+	}
+
+	j.Unlock()
+
+	<-j.disconnectSign
+}
+
+func (j *JetStream) subscribe(subject string, c PullConsumer) error {
+	fetchSize := c.FetchSize
+	if fetchSize <= 0 {
+		fetchSize = DefaultFetchSize
+	}
+
+	buf := newMessageBuffer(fetchSize)
+	j.buffers[subject] = buf
+
+	sub, err := j.js.PullSubscribe(subject, c.Durable, c.Options...)
+	if err != nil {
+		j.log.Error(fmt.Errorf("Subscribe error %s: %s", subject, err))
+
+		j.subError[subject] = err
+
+		return err
+	}
+
+	j.fetchers.Add(1)
+	go j.fetch(subject, sub, buf)
+
+	return nil
+}
+
+//Subscribe adds subject to read. If consumer of subject is not given to
+//constructor, it is created by NewPullConsumer with default settings and
+//durable name made of client and subject
+func (j *JetStream) Subscribe(subject string) error {
+	j.Lock()
+	defer j.Unlock()
+
+	if j.consumers == nil {
+		j.consumers = make(map[string]PullConsumer)
+	}
+
+	c, ok := j.consumers[subject]
+	if !ok {
+		c = NewPullConsumer(config.QueueData{DurableName: durableName(j.client, subject)})
+
+		j.consumers[subject] = c
+	}
+
+	if j.ConnectionState != Reading && j.ConnectionState != NothingToRead {
+		return nil
+	}
+
+	if _, isExists := j.buffers[subject]; isExists {
+		return nil
+	}
+
+	if err := j.subscribe(subject, c); err != nil {
+		return err
+	}
+
+	j.ConnectionState = Reading
+
+	return nil
+}
+
+//durableName replaces symbols, which are not allowed in durable name
+func durableName(client string, subject string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(client + "_" + subject)
+}
+
+//fetch requests as many messages as buffer can keep. It stops when
+//buffer is closed. Subscription is not unsubscribed, because it deletes
+//durable consumer with its ack state. It is closed with connection
+func (j *JetStream) fetch(subject string, sub *nats.Subscription, buf *messageBuffer) {
+	defer j.fetchers.Done()
+
+	for {
+		free := buf.waitFree()
+		if free == 0 {
+			return
+		}
+
+		msgs, err := sub.Fetch(free, nats.MaxWait(DefaultFetchWait))
+		if err != nil && err != nats.ErrTimeout {
+			j.log.Error(fmt.Errorf("Fetch error %s: %s", subject, err))
+
+			select {
+			case <-j.stop:
+				return
+			case <-time.After(fetchFailureBackoff):
+			}
+		}
+
+		var isStored bool
+
+		for _, m := range msgs {
+			meta, err := m.Metadata()
+			if err != nil {
+				j.log.Error(fmt.Errorf("Message of %s without metadata: %s", subject, err))
+
+				continue
+			}
+
+			msg := m
+
+			isStored = buf.put(&Message{
+				Subject:     m.Subject,
+				Sequence:    meta.Sequence.Stream,
+				Data:        m.Data,
+				Redelivered: meta.NumDelivered > 1,
+				ack:         func() error { return msg.Ack() },
+			}) || isStored
+		}
+
+		if isStored {
+			j.signal(subject)
+		}
+	}
+}
+
+func (j *JetStream) CloseWithTimeout(d time.Duration) {
+	j.Lock()
+	defer j.Unlock()
+
+	select {
+	case j.disconnectSign <- true:
+	case <-time.After(d):
+	}
+
+	for _, buf := range j.buffers {
+		buf.close()
+	}
+
+	if j.stop != nil {
+		close(j.stop)
+		j.fetchers.Wait()
+		j.stop = nil
+	}
+
+	j.buffers = make(map[string]*messageBuffer)
+	j.subError = make(map[string]error)
+
+	if j.conn != nil {
+		j.conn.Close()
+	}
+
+	j.ConnectionState = Disconnected
+}
+
+func (j *JetStream) IsQueueActive(subject string) (bool, error) {
+	j.RLock()
+	defer j.RUnlock()
+
+	if j.ConnectionState != Reading {
+		return false, nil
+	}
+
+	if err := j.subError[subject]; err != nil {
+		return false, err
+	}
+
+	if _, isExists := j.buffers[subject]; !isExists {
+		return false, fmt.Errorf("Subscription %s not exists", subject)
+	}
+
+	return true, nil
+}
+
+//GetMessages returns up to limit the oldest not acknowledged messages
+//in stream sequence order. Zero limit means all messages
+func (j *JetStream) GetMessages(subject string, limit int) ([]*Message, error) {
+	isActive, err := j.IsQueueActive(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isActive {
+		return nil, nil
+	}
+
+	buf, ok := j.buffer(subject)
+	if !ok {
+		return nil, nil
+	}
+
+	return buf.get(limit), nil
+}
+
+func (j *JetStream) buffer(subject string) (*messageBuffer, bool) {
+	j.RLock()
+	defer j.RUnlock()
+
+	buf, ok := j.buffers[subject]
+
+	return buf, ok
+}
+
+//Ack explicitly acknowledges messages and frees place for next fetch
+func (j *JetStream) Ack(m map[uint64]*Message, subject string) {
+	buf, ok := j.buffer(subject)
+	if !ok {
+		return
+	}
+
+	sequences := make([]uint64, 0, len(m))
+
+	for sequence, msg := range m {
+		sequences = append(sequences, sequence)
+
+		if err := msg.Ack(); err != nil {
+			j.log.Error(fmt.Errorf("Unable to ack message %d of %s: %s", sequence, subject, err))
+		}
+	}
+
+	buf.remove(sequences)
+}
+
+//Stats returns state of buffers of subscribed subjects
+func (j *JetStream) Stats() map[string]BufferStats {
+	j.RLock()
+	defer j.RUnlock()
+
+	return bufferStats(j.buffers)
+}
+
+func (j *JetStream) Publish(subject string, msg []byte) error {
+	j.RLock()
+	defer j.RUnlock()
+
+	if j.ConnectionState < NothingToRead || j.ConnectionState > Reading {
+		return fmt.Errorf("bad state for publish: %d", j.ConnectionState)
+	}
+
+	_, err := j.js.Publish(subject, msg)
+
+	return err
+}
+
+//PublishAsync publishes msg to stream. ah is called when stream
+//acknowledges message or DefaultPublishWait passes
+func (j *JetStream) PublishAsync(subject string, msg []byte, ah AckHandler) (string, error) {
+	j.RLock()
+	defer j.RUnlock()
+
+	if j.ConnectionState < NothingToRead || j.ConnectionState > Reading {
+		return "", fmt.Errorf("bad state for publish: %d", j.ConnectionState)
+	}
+
+	future, err := j.js.PublishAsync(subject, msg)
+	if err != nil {
+		return "", err
+	}
+
+	if ah == nil {
+		return "", nil
+	}
+
+	go func() {
+		select {
+		case pa := <-future.Ok():
+			ah(fmt.Sprintf("%s:%d", pa.Stream, pa.Sequence), nil)
+		case err := <-future.Err():
+			ah("", err)
+		case <-time.After(DefaultPublishWait):
+			ah("", nats.ErrTimeout)
+		}
+	}()
+
+	return "", nil
+}
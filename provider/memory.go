@@ -0,0 +1,266 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMemoryAckWait     = 30 * time.Second
+	DefaultMemoryMaxInFlight = 1024
+)
+
+type memoryMessage struct {
+	data       []byte
+	delivered  bool
+	deliveries int
+	deadline   time.Time
+}
+
+type memorySubject struct {
+	lastSequence uint64
+	subscribed   bool
+	msgs         map[uint64]*memoryMessage
+}
+
+//Memory is in-memory broker for tests. Published messages get growing
+//sequence of their subject and are kept until acknowledged. Up to
+//maxInFlight messages of subscribed subject are delivered, delivered
+//message is redelivered if it is not acknowledged during ackWait
+type Memory struct {
+	ackWait     time.Duration
+	maxInFlight int
+	subjects    map[string]*memorySubject
+	mu          sync.Mutex
+	notifier
+}
+
+func NewMemoryBroker(ackWait time.Duration, maxInFlight int) *Memory {
+	if ackWait <= 0 {
+		ackWait = DefaultMemoryAckWait
+	}
+
+	if maxInFlight <= 0 {
+		maxInFlight = DefaultMemoryMaxInFlight
+	}
+
+	return &Memory{
+		ackWait:     ackWait,
+		maxInFlight: maxInFlight,
+		subjects:    make(map[string]*memorySubject),
+	}
+}
+
+func (m *Memory) Url() string {
+	return "memory"
+}
+
+func (m *Memory) subject(subject string) *memorySubject {
+	s, ok := m.subjects[subject]
+	if !ok {
+		s = &memorySubject{msgs: make(map[uint64]*memoryMessage)}
+		m.subjects[subject] = s
+	}
+
+	return s
+}
+
+func (m *Memory) Subscribe(subject string) error {
+	m.mu.Lock()
+	s := m.subject(subject)
+	s.subscribed = true
+	isDelivered := m.deliver(s)
+	m.mu.Unlock()
+
+	if isDelivered {
+		m.signal(subject)
+	}
+
+	return nil
+}
+
+func (m *Memory) IsQueueActive(subject string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.subjects[subject]; !ok || !s.subscribed {
+		return false, fmt.Errorf("Subscription %s not exists", subject)
+	}
+
+	return true, nil
+}
+
+//deliver marks the oldest not delivered messages as delivered while
+//count of messages in flight is less than maxInFlight. Delivered messages
+//with expired ack wait are redelivered
+func (m *Memory) deliver(s *memorySubject) bool {
+	if !s.subscribed {
+		return false
+	}
+
+	now := time.Now()
+
+	sequences := make([]uint64, 0, len(s.msgs))
+	inFlight := 0
+
+	for sequence, msg := range s.msgs {
+		sequences = append(sequences, sequence)
+
+		if msg.delivered {
+			inFlight++
+		}
+	}
+
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+
+	var isDelivered bool
+
+	for _, sequence := range sequences {
+		msg := s.msgs[sequence]
+
+		switch {
+		case msg.delivered && now.After(msg.deadline):
+			msg.deliveries++
+			msg.deadline = now.Add(m.ackWait)
+			isDelivered = true
+		case !msg.delivered && inFlight < m.maxInFlight:
+			msg.delivered = true
+			msg.deliveries++
+			msg.deadline = now.Add(m.ackWait)
+			inFlight++
+			isDelivered = true
+		}
+	}
+
+	return isDelivered
+}
+
+func (m *Memory) GetMessages(subject string, limit int) ([]*Message, error) {
+	if _, err := m.IsQueueActive(subject); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+
+	s := m.subject(subject)
+	m.deliver(s)
+
+	sequences := make([]uint64, 0, len(s.msgs))
+
+	for sequence, msg := range s.msgs {
+		if msg.delivered {
+			sequences = append(sequences, sequence)
+		}
+	}
+
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+
+	if limit > 0 && limit < len(sequences) {
+		sequences = sequences[:limit]
+	}
+
+	msgs := make([]*Message, 0, len(sequences))
+
+	for _, sequence := range sequences {
+		msg := s.msgs[sequence]
+		seq := sequence
+
+		msgs = append(msgs, &Message{
+			Subject:     subject,
+			Sequence:    seq,
+			Data:        msg.data,
+			Redelivered: msg.deliveries > 1,
+			ack: func() error {
+				return m.ack(subject, seq)
+			},
+		})
+	}
+
+	m.mu.Unlock()
+
+	return msgs, nil
+}
+
+func (m *Memory) ack(subject string, sequence uint64) error {
+	m.mu.Lock()
+
+	s := m.subject(subject)
+
+	if _, ok := s.msgs[sequence]; !ok {
+		m.mu.Unlock()
+
+		return fmt.Errorf("Message %d of %s is not found", sequence, subject)
+	}
+
+	delete(s.msgs, sequence)
+
+	isDelivered := m.deliver(s)
+
+	m.mu.Unlock()
+
+	if isDelivered {
+		m.signal(subject)
+	}
+
+	return nil
+}
+
+func (m *Memory) Ack(msgs map[uint64]*Message, subject string) {
+	for sequence := range msgs {
+		m.ack(subject, sequence)
+	}
+}
+
+//Pending returns count of not acknowledged messages of subject
+func (m *Memory) Pending(subject string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.subject(subject).msgs)
+}
+
+func (m *Memory) Publish(subject string, msg []byte) error {
+	_, err := m.publish(subject, msg)
+
+	return err
+}
+
+func (m *Memory) publish(subject string, msg []byte) (uint64, error) {
+	data := make([]byte, len(msg))
+	copy(data, msg)
+
+	m.mu.Lock()
+
+	s := m.subject(subject)
+	s.lastSequence++
+	s.msgs[s.lastSequence] = &memoryMessage{data: data}
+
+	sequence := s.lastSequence
+	isDelivered := m.deliver(s)
+
+	m.mu.Unlock()
+
+	if isDelivered {
+		m.signal(subject)
+	}
+
+	return sequence, nil
+}
+
+//PublishAsync stores msg and calls ah in separate goroutine
+func (m *Memory) PublishAsync(subject string, msg []byte, ah AckHandler) (string, error) {
+	sequence, err := m.publish(subject, msg)
+	if err != nil {
+		return "", err
+	}
+
+	guid := fmt.Sprintf("%s:%d", subject, sequence)
+
+	if ah != nil {
+		go ah(guid, nil)
+	}
+
+	return guid, nil
+}
@@ -1,11 +1,14 @@
 package provider
 
 import (
-	"github.com/DmitriBeattie/custom-framework/interfaces/app"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/DmitriBeattie/custom-framework/interfaces/app"
 	"sync"
 	"time"
 
+	nats "github.com/nats-io/nats.go"
 	stan "github.com/nats-io/stan.go"
 )
 
@@ -17,10 +20,20 @@ const (
 	NothingToRead
 	Reading
 	Disconnected
+	Connecting
 )
 
 type QueueState uint8
 
+//RequestHandler returns reply to request. Nothing is replied if error
+//is returned, so requester gets timeout
+type RequestHandler func(data []byte) ([]byte, error)
+
+type responder struct {
+	group   string
+	handler RequestHandler
+}
+
 type Messages struct {
 	sync.RWMutex
 	msgs map[string]map[uint64]*stan.Msg
@@ -34,28 +47,89 @@ type NATS struct {
 	sub        []stan.Subscription
 	conn       stan.Conn
 	log        app.Logger
-	msgs       map[string]map[uint64]*stan.Msg
-	processed  map[string]map[uint64]*stan.Msg
-	queueLock  map[string]*sync.RWMutex
+	buffers    map[string]*messageBuffer
+	bufferSize map[string]int
+	queueGroup map[string]string
+	responders map[string]responder
+	respSub    []*nats.Subscription
 	subError   map[string]error
 	sync.RWMutex
 	ConnectionState
-	disconnectSign chan bool
+	backoff  backoff
+	lost     chan error
+	cancel   context.CancelFunc
+	done     chan struct{}
+	watchers stateWatchers
+	notifier
 }
 
 func CreateNATSConnection(_url string, _client string, _cluster string, _subSetting map[string][]stan.SubscriptionOption, _log app.Logger) *NATS {
 	return &NATS{
-		url:            _url,
-		client:         _client,
-		cluster:        _cluster,
-		subSetting:     _subSetting,
-		log:            _log,
-		msgs:           make(map[string]map[uint64]*stan.Msg),
-		processed:      make(map[string]map[uint64]*stan.Msg),
-		queueLock:      make(map[string]*sync.RWMutex),
-		disconnectSign: make(chan bool),
-		subError:       make(map[string]error),
+		url:        _url,
+		client:     _client,
+		cluster:    _cluster,
+		subSetting: _subSetting,
+		log:        _log,
+		buffers:    make(map[string]*messageBuffer),
+		bufferSize: make(map[string]int),
+		queueGroup: make(map[string]string),
+		responders: make(map[string]responder),
+		subError:   make(map[string]error),
+		backoff:    backoff{DefaultReconnectMin, DefaultReconnectMax},
+	}
+}
+
+//WithQueueGroups makes subjects to be read by queue subscriptions, so
+//replicas with the same group share messages of subject
+func (n *NATS) WithQueueGroups(groups map[string]string) *NATS {
+	for subject, group := range groups {
+		n.queueGroup[subject] = group
+	}
+
+	return n
+}
+
+//WithBackoff sets bounds of delay between reconnection attempts
+func (n *NATS) WithBackoff(min time.Duration, max time.Duration) *NATS {
+	if min > 0 {
+		n.backoff.min = min
+	}
+
+	if max >= n.backoff.min {
+		n.backoff.max = max
+	} else {
+		n.backoff.max = n.backoff.min
+	}
+
+	return n
+}
+
+//WatchState returns channel of connection state changes and function,
+//which stops watching. Events are dropped if channel is not read
+func (n *NATS) WatchState() (<-chan StateEvent, func()) {
+	return n.watchers.watch()
+}
+
+//setState should be called under lock
+func (n *NATS) setState(state ConnectionState, err error) {
+	if n.ConnectionState == state && err == nil {
+		return
+	}
+
+	n.ConnectionState = state
+
+	n.watchers.send(StateEvent{State: state, Err: err, Time: time.Now()})
+}
+
+//WithBufferSize limits count of not acknowledged messages kept for
+//subjects. When buffer is full, delivery waits until messages are
+//acknowledged. DefaultBufferSize is used for other subjects
+func (n *NATS) WithBufferSize(sizes map[string]int) *NATS {
+	for subject, size := range sizes {
+		n.bufferSize[subject] = size
 	}
+
+	return n
 }
 
 func (n *NATS) GetState() ConnectionState {
@@ -73,115 +147,277 @@ func (n *NATS) getState() ConnectionState {
 	return n.ConnectionState
 }
 
-func (n *NATS) Open() {
-	n.Lock()
+//Run connects to server, subscribes subjects and keeps connection until
+//ctx is done or Close is called. Failed or lost connection is opened
+//again after backoff, durable subscriptions are resumed. Error of ctx
+//is returned, nil is returned after Close
+func (n *NATS) Run(ctx context.Context) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	if n.ConnectionState != Disconnected && n.ConnectionState != ConnectionFailed && n.ConnectionState != IsNotActive {
-		n.log.Error(fmt.Errorf("Невозможно открыть соединение. Статус: %d", n.ConnectionState))
+	n.Lock()
 
+	if n.cancel != nil {
 		n.Unlock()
 
-		return
+		return errors.New("Connection is already running")
 	}
 
-	var err error
+	n.cancel = cancel
+	n.done = make(chan struct{})
+
+	n.Unlock()
+
+	defer func() {
+		n.Lock()
+		defer n.Unlock()
+
+		n.close()
+		n.setState(Disconnected, nil)
+
+		n.cancel = nil
+		close(n.done)
+	}()
+
+	attempt := 0
+
+	for {
+		lost, err := n.connect()
+		if err == nil {
+			attempt = 0
+
+			select {
+			case <-runCtx.Done():
+				return ctx.Err()
+			case err = <-lost:
+			}
+
+			n.log.Error(fmt.Errorf("Connection to nats %s is lost: %s", n.url, err))
+
+			n.Lock()
+			n.close()
+			n.setState(Disconnected, err)
+			n.Unlock()
+		}
+
+		delay := n.backoff.delay(attempt)
+		attempt++
+
+		select {
+		case <-runCtx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+//connect opens connection and subscribes all subjects. Returned channel
+//receives reason of connection loss
+func (n *NATS) connect() (<-chan error, error) {
+	n.Lock()
+	defer n.Unlock()
 
-	//log_std.Println(q.Cfg)
-	n.conn, err = stan.Connect(n.cluster, n.client, stan.NatsURL(n.url), stan.SetConnectionLostHandler(n.Reconnect))
+	n.setState(Connecting, nil)
 
+	lost := make(chan error, 1)
+
+	conn, err := stan.Connect(n.cluster, n.client, stan.NatsURL(n.url), stan.SetConnectionLostHandler(func(_ stan.Conn, err error) {
+		select {
+		case lost <- err:
+		default:
+		}
+	}))
 	if err != nil {
-		if n.conn != nil {
-			n.conn.Close()
+		if conn != nil {
+			conn.Close()
 		}
 
 		n.log.Error(fmt.Errorf("Can't connect: %s.\nMake sure a NATS Streaming Server is running at: %s", err.Error(), n.url))
 
-		n.ConnectionState = ConnectionFailed
-
-		n.Unlock()
+		n.setState(ConnectionFailed, err)
 
-		return
+		return nil, err
 	}
 
+	n.conn = conn
+	n.lost = lost
+
+	//Durable name is kept in settings, so reading continues from the last acknowledged message
 	for subject, settings := range n.subSetting {
-		mu := sync.RWMutex{}
+		n.subscribe(subject, settings)
+	}
+
+	for subject, r := range n.responders {
+		n.respond(subject, r)
+	}
+
+	if len(n.sub) == 0 {
+		n.log.Error("Nothing to read from nats " + n.url)
 
-		n.queueLock[subject] = &mu
-		n.processed[subject] = make(map[uint64]*stan.Msg)
-		n.msgs[subject] = make(map[uint64]*stan.Msg)
+		n.setState(NothingToRead, nil)
+	} else {
+		n.setState(Reading, nil)
+	}
+
+	return lost, nil
+}
+
+//Open runs connection until Close is called
+func (n *NATS) Open() {
+	n.Run(context.Background())
+}
 
-		sub, err := n.conn.Subscribe(
+func (n *NATS) subscribe(subject string, settings []stan.SubscriptionOption) error {
+	n.buffers[subject] = newMessageBuffer(n.bufferSize[subject])
+
+	var sub stan.Subscription
+	var err error
+
+	if group := n.queueGroup[subject]; group != "" {
+		sub, err = n.conn.QueueSubscribe(
 			subject,
+			group,
 			n.HandleMessages(subject),
 			settings...,
 		)
-		if sub != nil {
-			n.sub = append(n.sub, sub)
-		}
-		if err != nil {
-			n.log.Error(fmt.Errorf("Subscribe error %s: %s", subject, err))
+	} else {
+		sub, err = n.conn.Subscribe(
+			subject,
+			n.HandleMessages(subject),
+			settings...,
+		)
+	}
+	if sub != nil {
+		n.sub = append(n.sub, sub)
+	}
+	if err != nil {
+		n.log.Error(fmt.Errorf("Subscribe error %s: %s", subject, err))
 
-			n.subError[subject] = err
-		}
+		n.subError[subject] = err
 	}
 
-	if len(n.sub) == 0 {
-		n.log.Error("Nothing to read from nats " + n.url)
+	return err
+}
 
-		n.ConnectionState = NothingToRead
-	} else {
-		n.ConnectionState = Reading
+//Subscribe adds subject to read with settings given to constructor.
+//If connection is open, subject is subscribed at once, otherwise
+//it is subscribed by Open
+func (n *NATS) Subscribe(subject string) error {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.subSetting == nil {
+		n.subSetting = make(map[string][]stan.SubscriptionOption)
 	}
 
-	n.Unlock()
+	settings := n.subSetting[subject]
+	n.subSetting[subject] = settings
+
+	if n.ConnectionState != Reading && n.ConnectionState != NothingToRead {
+		return nil
+	}
+
+	if _, isExists := n.buffers[subject]; isExists {
+		return nil
+	}
 
-	<-n.disconnectSign
+	if err := n.subscribe(subject, settings); err != nil {
+		return err
+	}
+
+	n.setState(Reading, nil)
+
+	return nil
 }
 
+//Reconnect makes running connection to be opened again
 func (n *NATS) Reconnect(c stan.Conn, err error) {
-	n.log.Error(fmt.Errorf("Reconnection to nats, because %s", err))
+	n.RLock()
+	lost := n.lost
+	n.RUnlock()
 
-	n.CloseWithTimeout(10 * time.Second)
-	n.Open()
+	if lost == nil {
+		return
+	}
+
+	select {
+	case lost <- err:
+	default:
+	}
 }
 
+//Close stops Run and waits until connection is closed
+func (n *NATS) Close() {
+	n.RLock()
+	cancel, done := n.cancel, n.done
+	n.RUnlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
+}
+
+//CloseWithTimeout stops Run and waits until connection is closed
+//no longer than d
 func (n *NATS) CloseWithTimeout(d time.Duration) {
-	n.Lock()
-	defer n.Unlock()
+	n.RLock()
+	cancel, done := n.cancel, n.done
+	n.RUnlock()
 
-	select {
-	case n.disconnectSign <- true:
-	case <-time.After(d):
+	if cancel == nil {
+		return
 	}
 
-	n.close()
+	cancel()
 
-	n.ConnectionState = Disconnected
+	select {
+	case <-done:
+	case <-time.After(d):
+	}
 }
 
-func (n *NATS) Ack(m map[uint64]*stan.Msg, subject string) {
-	mu := n.queueLock[subject]
-	mu.Lock()
-	defer mu.Unlock()
+func (n *NATS) buffer(subject string) (*messageBuffer, bool) {
+	n.RLock()
+	defer n.RUnlock()
 
-	n.processed[subject] = m
+	buf, ok := n.buffers[subject]
 
-	curMsgs := n.msgs[subject]
+	return buf, ok
+}
 
-	for sequence := range m {
-		delete(curMsgs, sequence)
+func (n *NATS) Ack(m map[uint64]*Message, subject string) {
+	buf, ok := n.buffer(subject)
+	if !ok {
+		return
 	}
 
-	n.msgs[subject] = curMsgs
+	sequences := make([]uint64, 0, len(m))
+
+	for sequence, msg := range m {
+		sequences = append(sequences, sequence)
 
-	for _, msg := range m {
 		msg.Ack()
 	}
+
+	buf.remove(sequences)
+}
+
+//Stats returns state of buffers of subscribed subjects
+func (n *NATS) Stats() map[string]BufferStats {
+	n.RLock()
+	defer n.RUnlock()
+
+	return bufferStats(n.buffers)
 }
 
 func (n *NATS) IsQueueActive(subject string) (bool, error) {
-	st := n.GetState()
-	if st != Reading {
+	n.RLock()
+	defer n.RUnlock()
+
+	if n.getState() != Reading {
 		return false, nil
 	}
 
@@ -189,49 +425,63 @@ func (n *NATS) IsQueueActive(subject string) (bool, error) {
 		return false, err
 	}
 
-	if _, isExists := n.queueLock[subject]; !isExists {
+	if _, isExists := n.buffers[subject]; !isExists {
 		return false, fmt.Errorf("Subscription %s not exists", subject)
 	}
 
 	return true, nil
 }
 
+//HandleMessages stores delivered messages in buffer of subject. It
+//should be called after buffer is created
 func (n *NATS) HandleMessages(subject string) stan.MsgHandler {
-	return func(m *stan.Msg) {
-		mu := n.queueLock[subject]
-		mu.Lock()
-		defer mu.Unlock()
-
-		processed := n.processed[subject]
+	buf := n.buffers[subject]
 
-		if _, found := processed[m.Sequence]; found {
-			return
+	return func(m *stan.Msg) {
+		msg := &Message{
+			Subject:     m.Subject,
+			Sequence:    m.Sequence,
+			Data:        m.Data,
+			Redelivered: m.Redelivered,
+			ack:         m.Ack,
 		}
 
-		msg := n.msgs[subject]
-
-		msg[m.Sequence] = m
-
-		n.msgs[subject] = msg
+		if buf.put(msg) {
+			n.signal(subject)
+		}
 	}
 }
 
 func (n *NATS) close() {
+	//Deliveries waiting for free place are released before subscriptions are closed
+	for _, buf := range n.buffers {
+		buf.close()
+	}
+
 	for i := range n.sub {
 		n.sub[i].Close()
 	}
 
-	n.msgs = make(map[string]map[uint64]*stan.Msg)
-	n.processed = make(map[string]map[uint64]*stan.Msg)
+	n.sub = nil
+
+	for i := range n.respSub {
+		n.respSub[i].Unsubscribe()
+	}
+
+	n.respSub = nil
+	n.buffers = make(map[string]*messageBuffer)
 	n.subError = make(map[string]error)
-	n.queueLock = make(map[string]*sync.RWMutex)
+	n.lost = nil
 
 	if n.conn != nil {
 		n.conn.Close()
+		n.conn = nil
 	}
 }
 
-func (n *NATS) GetMessages(subject string) (map[uint64]*stan.Msg, error) {
+//GetMessages returns up to limit the oldest not acknowledged messages
+//in sequence order. Zero limit means all messages
+func (n *NATS) GetMessages(subject string, limit int) ([]*Message, error) {
 	isActive, err := n.IsQueueActive(subject)
 	if err != nil {
 		return nil, err
@@ -241,17 +491,12 @@ func (n *NATS) GetMessages(subject string) (map[uint64]*stan.Msg, error) {
 		return nil, nil
 	}
 
-	mu := n.queueLock[subject]
-	mu.RLock()
-	defer mu.RUnlock()
-
-	copiedMsg := make(map[uint64]*stan.Msg, len(n.msgs[subject]))
-
-	for sequence, msg := range n.msgs[subject] {
-		copiedMsg[sequence] = msg
+	buf, ok := n.buffer(subject)
+	if !ok {
+		return nil, nil
 	}
 
-	return copiedMsg, nil
+	return buf.get(limit), nil
 }
 
 func (n *NATS) Publish(subject string, msg []byte) error {
@@ -266,3 +511,99 @@ func (n *NATS) Publish(subject string, msg []byte) error {
 
 	return n.conn.Publish(subject, msg)
 }
+
+//PublishAsync publishes msg without waiting for acknowledgment of server.
+//ah is called when message is acknowledged or publishing fails
+func (n *NATS) PublishAsync(subject string, msg []byte, ah AckHandler) (string, error) {
+	n.RLock()
+	defer n.RUnlock()
+
+	st := n.getState()
+
+	if st < NothingToRead || st > Reading {
+		return "", fmt.Errorf("bad state for publish: %d", st)
+	}
+
+	return n.conn.PublishAsync(subject, msg, stan.AckHandler(ah))
+}
+
+//Request sends data to subject of core NATS and waits for reply no
+//longer than timeout
+func (n *NATS) Request(subject string, data []byte, timeout time.Duration) ([]byte, error) {
+	n.RLock()
+
+	st := n.getState()
+
+	if st < NothingToRead || st > Reading {
+		n.RUnlock()
+
+		return nil, fmt.Errorf("bad state for request: %d", st)
+	}
+
+	nc := n.conn.NatsConn()
+
+	n.RUnlock()
+
+	//Lock is not held while waiting, so reading and acknowledging go on
+	msg, err := nc.Request(subject, data, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Request to %s: %w", subject, err)
+	}
+
+	return msg.Data, nil
+}
+
+//Respond replies to requests of subject by h. Requests are shared
+//between responders of the same group. Empty group means every
+//responder gets request. Responder is restored after reconnection
+func (n *NATS) Respond(subject string, group string, h RequestHandler) error {
+	n.Lock()
+	defer n.Unlock()
+
+	if _, isExists := n.responders[subject]; isExists {
+		return fmt.Errorf("Responder of %s already exists", subject)
+	}
+
+	r := responder{group, h}
+
+	n.responders[subject] = r
+
+	if n.ConnectionState != Reading && n.ConnectionState != NothingToRead {
+		return nil
+	}
+
+	return n.respond(subject, r)
+}
+
+func (n *NATS) respond(subject string, r responder) error {
+	handler := func(m *nats.Msg) {
+		reply, err := r.handler(m.Data)
+		if err != nil {
+			n.log.Error(fmt.Errorf("Request of %s is not handled: %s", subject, err))
+
+			return
+		}
+
+		if err := m.Respond(reply); err != nil {
+			n.log.Error(fmt.Errorf("Unable to reply to %s: %s", subject, err))
+		}
+	}
+
+	var sub *nats.Subscription
+	var err error
+
+	if r.group != "" {
+		sub, err = n.conn.NatsConn().QueueSubscribe(subject, r.group, handler)
+	} else {
+		sub, err = n.conn.NatsConn().Subscribe(subject, handler)
+	}
+	if err != nil {
+		n.log.Error(fmt.Errorf("Responder subscribe error %s: %s", subject, err))
+
+		return err
+	}
+
+	n.respSub = append(n.respSub, sub)
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package provider
+
+import (
+	"sync"
+)
+
+//notifier signals about new messages of subjects. Signals are not
+//queued, so one signal could stand for several messages
+type notifier struct {
+	notify     map[string][]chan struct{}
+	notifyLock sync.Mutex
+}
+
+//Notify returns channel, which receives signal when new messages of
+//subject are delivered. Every call returns own channel, so watchers
+//don't take signals of each other
+func (n *notifier) Notify(subject string) <-chan struct{} {
+	n.notifyLock.Lock()
+	defer n.notifyLock.Unlock()
+
+	if n.notify == nil {
+		n.notify = make(map[string][]chan struct{})
+	}
+
+	ch := make(chan struct{}, 1)
+	n.notify[subject] = append(n.notify[subject], ch)
+
+	return ch
+}
+
+func (n *notifier) signal(subject string) {
+	n.notifyLock.Lock()
+	defer n.notifyLock.Unlock()
+
+	for _, ch := range n.notify[subject] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
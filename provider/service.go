@@ -30,6 +30,11 @@ func (s *ServiceRequest) CreateRequest(body io.Reader, additionalQuery url.Value
 		return nil, errors.New("Url is not set")
 	}
 
+	//Query is changed below, so url is copied to let several goroutines
+	//create requests from one instance
+	u := *sCopy.U
+	sCopy.U = &u
+
 	if len(urlPatternReplacement) > 0 {
 		urlRaw, err := url.PathUnescape(sCopy.U.String())
 		if err != nil {
@@ -0,0 +1,117 @@
+package provider
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultReconnectMin = time.Second
+	DefaultReconnectMax = time.Minute
+	stateEventBuffer    = 16
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case IsNotActive:
+		return "not active"
+	case ConnectionFailed:
+		return "failed"
+	case NothingToRead:
+		return "nothing to read"
+	case Reading:
+		return "reading"
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	default:
+		return "unknown"
+	}
+}
+
+//StateEvent is sent to watchers when connection state changes. Err is
+//the reason of ConnectionFailed and Disconnected states
+type StateEvent struct {
+	State ConnectionState
+	Err   error
+	Time  time.Time
+}
+
+type stateWatchers struct {
+	watchers map[int]chan StateEvent
+	lastID   int
+	mu       sync.Mutex
+}
+
+//watch returns channel of state events and function, which stops
+//watching and closes the channel
+func (w *stateWatchers) watch() (<-chan StateEvent, func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.watchers == nil {
+		w.watchers = make(map[int]chan StateEvent)
+	}
+
+	w.lastID++
+
+	id := w.lastID
+	ch := make(chan StateEvent, stateEventBuffer)
+
+	w.watchers[id] = ch
+
+	var once sync.Once
+
+	return ch, func() {
+		once.Do(func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+
+			delete(w.watchers, id)
+			close(ch)
+		})
+	}
+}
+
+//send does not wait for slow watchers, event is dropped if their
+//channel is full
+func (w *stateWatchers) send(e StateEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, ch := range w.watchers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+//backoff returns exponentially growing delay with jitter. Delay is
+//chosen randomly between half and full of min*2^attempt, limited by max
+type backoff struct {
+	min time.Duration
+	max time.Duration
+}
+
+func (b backoff) delay(attempt int) time.Duration {
+	d := b.min
+
+	for i := 0; i < attempt && d < b.max; i++ {
+		d *= 2
+	}
+
+	if d > b.max {
+		d = b.max
+	}
+
+	if d <= 1 {
+		return d
+	}
+
+	half := d / 2
+
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}